@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"io"
+	"log"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/pkg/errors"
@@ -13,11 +15,12 @@ import (
 // App represents the V3 API JSON object of an app
 // http://v3-apidocs.cloudfoundry.org/version/3.34.0/index.html#the-app-object
 type App struct {
-	GUID      string `json:"guid"`
-	Name      string `json:"name"`
-	State     string `json:"state"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	GUID      string   `json:"guid"`
+	Name      string   `json:"name"`
+	State     string   `json:"state"`
+	CreatedAt string   `json:"created_at"`
+	UpdatedAt string   `json:"updated_at"`
+	Metadata  Metadata `json:"metadata"`
 	Lifecycle struct {
 		Type string `json:"type"`
 		Data struct {
@@ -25,27 +28,31 @@ type App struct {
 			Stack      string   `json:"stack,omitempty"`
 		} `json:"data,omitempty"`
 	} `json:"lifecycle"`
+	Relationships struct {
+		Space struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"space"`
+	} `json:"relationships"`
+	// Space and Org are filled in from the resources included with the app listing.
+	Space Space        `json:"-"`
+	Org   Organization `json:"-"`
 }
 
-// AppResponse represents the V3 API JSON Response when querying for apps.
-type AppResponse struct {
-	Pagination struct {
-		TotalResults int `json:"total_results"`
-		TotalPages   int `json:"total_pages"`
-		First        struct {
-			Href string `json:"href"`
-		} `json:"first"`
-		Last struct {
-			Href string `json:"href"`
-		} `json:"last"`
-		Next struct {
-			Href string `json:"href,omitempty"`
-		} `json:"next,omitempty"`
-		Previous struct {
-			Href string `json:"href,omitempty"`
-		} `json:"previous,omitempty"`
-	} `json:"pagination"`
-	Apps []App `json:"resources"`
+// maxPerPage is the most resources the V3 API returns in a page.
+const maxPerPage = 5000
+
+// filterBatchSize is the most GUIDs put in one query filter, which keeps the URLs short.
+const filterBatchSize = 50
+
+// batchGUIDs splits the GUIDs into batches of up to filterBatchSize for query filters.
+func batchGUIDs(guids []string) [][]string {
+	var batches [][]string
+	for start := 0; start < len(guids); start += filterBatchSize {
+		batches = append(batches, guids[start:min(start+filterBatchSize, len(guids))])
+	}
+	return batches
 }
 
 // Droplet represents the V3 API JSON object of a droplet
@@ -60,57 +67,89 @@ type Droplet struct {
 		Name         string `json:"name"`
 		DetectOutput string `json:"detect_output"`
 	} `json:"buildpacks,omitempty"`
+	Relationships struct {
+		App struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"app"`
+	} `json:"relationships"`
 }
 
-// DropletResponse represents the V3 API JSON Response when querying for droplets.
-type DropletResponse struct {
-	Pagination struct {
-		TotalResults int `json:"total_results"`
-		TotalPages   int `json:"total_pages"`
-		First        struct {
-			Href string `json:"href"`
-		} `json:"first"`
-		Last struct {
-			Href string `json:"href"`
-		} `json:"last"`
-		Next struct {
-			Href string `json:"href,omitempty"`
-		} `json:"next,omitempty"`
-		Previous struct {
-			Href string `json:"href,omitempty"`
-		} `json:"previous,omitempty"`
-	} `json:"pagination"`
-	Droplets []Droplet `json:"resources"`
-}
-
-// ListApps will query for all V3 App objects
-// http://v3-apidocs.cloudfoundry.org/version/3.34.0/index.html#list-apps
-func ListApps(c *cfclient.Client) ([]App, error) {
-	apps := []App{}
-	requestURL := "/v3/apps"
-	for {
-		var appResp AppResponse
-		r := c.NewRequest("GET", requestURL)
-		resp, err := c.DoRequest(r)
-		if err != nil {
-			return nil, errors.Wrap(err, "Error requesting apps")
-		}
-		defer resp.Body.Close()
-		resBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, errors.Wrap(err, "Error reading app response")
-		}
+// Pagination represents the pagination of a V3 API JSON Response when listing resources.
+type Pagination struct {
+	TotalResults int `json:"total_results"`
+	TotalPages   int `json:"total_pages"`
+	Next         struct {
+		Href string `json:"href,omitempty"`
+	} `json:"next,omitempty"`
+}
 
-		err = json.Unmarshal(resBody, &appResp)
-		if err != nil {
-			return nil, errors.Wrap(err, "Error unmarshalling app")
-		}
+// Included represents the resources included in a V3 API JSON Response with the include parameter.
+type Included struct {
+	Users         []User         `json:"users,omitempty"`
+	Spaces        []Space        `json:"spaces,omitempty"`
+	Organizations []Organization `json:"organizations,omitempty"`
+}
+
+// ListResponse represents a page of a V3 API JSON Response when listing resources.
+type ListResponse[T any] struct {
+	Pagination Pagination `json:"pagination"`
+	Resources  []T        `json:"resources"`
+	Included   Included   `json:"included"`
+}
+
+// ListOptions are the parameters of a V3 API list request.
+type ListOptions struct {
+	// PerPage is the number of resources in each page. The API's default is used when it is 0.
+	PerPage int
+	// Filters are query filters, e.g. app_guids, or any other query parameters.
+	Filters url.Values
+	// LabelSelector selects resources by their labels, e.g. "env=prod,!legacy".
+	LabelSelector string
+	// Include asks for related resources to be included, e.g. space.organization.
+	Include []string
+	// OnPage is called after each page with the number of resources listed so far, if it is set.
+	OnPage func(listed int, pagination Pagination)
+}
 
-		for _, app := range appResp.Apps {
-			apps = append(apps, app)
+// listResources will query for all V3 objects at the path, following the pagination. The included resources of
+// all the pages are put together. If a page can't be got, the resources listed so far are returned with the error.
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#list-resources
+func listResources[T any](c *cfclient.Client, path string, opts ListOptions) ([]T, Included, error) {
+	query := url.Values{}
+	for key, values := range opts.Filters {
+		query[key] = values
+	}
+	if opts.PerPage > 0 {
+		query.Set("per_page", strconv.Itoa(opts.PerPage))
+	}
+	if opts.LabelSelector != "" {
+		query.Set("label_selector", opts.LabelSelector)
+	}
+	if len(opts.Include) > 0 {
+		query.Set("include", strings.Join(opts.Include, ","))
+	}
+	requestURL := path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	var resources []T
+	var included Included
+	for page := 1; ; page++ {
+		var listResp ListResponse[T]
+		if err := getResource(c, requestURL, &listResp); err != nil {
+			return resources, included, errors.Wrapf(err, "Error listing page %d of %s after %d resources", page, path, len(resources))
+		}
+		resources = append(resources, listResp.Resources...)
+		included.Users = append(included.Users, listResp.Included.Users...)
+		included.Spaces = append(included.Spaces, listResp.Included.Spaces...)
+		included.Organizations = append(included.Organizations, listResp.Included.Organizations...)
+		if opts.OnPage != nil {
+			opts.OnPage(len(resources), listResp.Pagination)
 		}
 
-		requestHref := appResp.Pagination.Next.Href
+		requestHref := listResp.Pagination.Next.Href
 		if requestHref == "" {
 			break
 		}
@@ -122,7 +161,38 @@ func ListApps(c *cfclient.Client) ([]App, error) {
 		if requestURL == "" {
 			break
 		}
+	}
+	return resources, included, nil
+}
 
+// ListApps will query for all V3 App objects matching the query filters, e.g. space_guids, including their
+// spaces and orgs
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#list-apps
+func ListApps(c *cfclient.Client, filters url.Values) ([]App, error) {
+	apps, included, err := listResources[App](c, "/v3/apps", ListOptions{
+		PerPage: maxPerPage,
+		Filters: filters,
+		Include: []string{"space.organization"},
+		OnPage: func(listed int, pagination Pagination) {
+			if pagination.TotalPages > 1 {
+				log.Printf("Listed %d of %d apps\n", listed, pagination.TotalResults)
+			}
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Error requesting apps")
+	}
+	spaces := make(map[string]Space)
+	for _, space := range included.Spaces {
+		spaces[space.GUID] = space
+	}
+	orgs := make(map[string]Organization)
+	for _, org := range included.Organizations {
+		orgs[org.GUID] = org
+	}
+	for i := range apps {
+		apps[i].Space = spaces[apps[i].Relationships.Space.Data.GUID]
+		apps[i].Org = orgs[apps[i].Space.Relationships.Organization.Data.GUID]
 	}
 	return apps, nil
 }
@@ -130,43 +200,138 @@ func ListApps(c *cfclient.Client) ([]App, error) {
 // GetDropletsByQuery will query for droplets using the passed in query parameters
 // http://v3-apidocs.cloudfoundry.org/version/3.34.0/index.html#list-droplets
 func (a *App) GetDropletsByQuery(c *cfclient.Client, query url.Values) ([]Droplet, error) {
-	var droplets []Droplet
-	requestURL := fmt.Sprintf("/v3/apps/%s/droplets?%s", a.GUID, query.Encode())
-	for {
-		var dropletResp DropletResponse
-		r := c.NewRequest("GET", requestURL)
-		resp, err := c.DoRequest(r)
-		if err != nil {
-			return nil, errors.Wrap(err, "Error requesting droplets")
-		}
-		defer resp.Body.Close()
-		resBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, errors.Wrap(err, "Error reading droplet response")
-		}
+	droplets, _, err := listResources[Droplet](c, "/v3/apps/"+a.GUID+"/droplets", ListOptions{Filters: query})
+	return droplets, errors.Wrap(err, "Error requesting droplets")
+}
 
-		err = json.Unmarshal(resBody, &dropletResp)
-		if err != nil {
-			return nil, errors.Wrap(err, "Error unmarshalling droplets")
-		}
+// ListDropletsByQuery will query for the droplets of any app using the passed in query parameters, e.g. app_guids
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#list-droplets
+func ListDropletsByQuery(c *cfclient.Client, query url.Values) ([]Droplet, error) {
+	droplets, _, err := listResources[Droplet](c, "/v3/droplets", ListOptions{PerPage: maxPerPage, Filters: query})
+	return droplets, errors.Wrap(err, "Error requesting droplets")
+}
 
-		for _, droplet := range dropletResp.Droplets {
-			droplets = append(droplets, droplet)
-		}
+// Buildpack represents the V3 API JSON object of a buildpack
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#the-buildpack-object
+type Buildpack struct {
+	GUID      string `json:"guid"`
+	Name      string `json:"name"`
+	Stack     string `json:"stack"`
+	State     string `json:"state"`
+	Filename  string `json:"filename"`
+	Enabled   bool   `json:"enabled"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
 
-		requestHref := dropletResp.Pagination.Next.Href
-		if requestHref == "" {
-			break
-		}
-		u, err := url.Parse(requestHref)
-		if err != nil {
-			break
-		}
-		requestURL = u.RequestURI()
-		if requestURL == "" {
-			break
-		}
+// ListBuildpacks will query for all V3 Buildpack objects
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#list-buildpacks
+func ListBuildpacks(c *cfclient.Client) ([]Buildpack, error) {
+	buildpacks, _, err := listResources[Buildpack](c, "/v3/buildpacks", ListOptions{PerPage: maxPerPage})
+	return buildpacks, errors.Wrap(err, "Error requesting buildpacks")
+}
 
+// Role represents the V3 API JSON object of a role
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#the-role-object
+type Role struct {
+	GUID          string `json:"guid"`
+	Type          string `json:"type"`
+	Relationships struct {
+		User struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"user"`
+		Space struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"space"`
+		Organization struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"organization"`
+	} `json:"relationships"`
+}
+
+// User represents the V3 API JSON object of a user
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#the-user-object
+type User struct {
+	GUID     string `json:"guid"`
+	Username string `json:"username"`
+	Origin   string `json:"origin"`
+}
+
+// ListRolesByQuery will query for roles and the users they belong to using the passed in query parameters
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#list-roles
+func ListRolesByQuery(c *cfclient.Client, query url.Values) ([]Role, map[string]User, error) {
+	roles, included, err := listResources[Role](c, "/v3/roles", ListOptions{PerPage: maxPerPage, Filters: query, Include: []string{"user"}})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error requesting roles")
+	}
+	users := make(map[string]User)
+	for _, user := range included.Users {
+		users[user.GUID] = user
+	}
+	return roles, users, nil
+}
+
+// Metadata represents the V3 API JSON object of the labels and annotations on a resource
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#metadata
+type Metadata struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// Space represents the V3 API JSON object of a space
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#the-space-object
+type Space struct {
+	GUID          string   `json:"guid"`
+	Name          string   `json:"name"`
+	Metadata      Metadata `json:"metadata"`
+	Relationships struct {
+		Organization struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"organization"`
+	} `json:"relationships"`
+}
+
+// Organization represents the V3 API JSON object of an organization
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#the-organization-object
+type Organization struct {
+	GUID     string   `json:"guid"`
+	Name     string   `json:"name"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// ListOrganizations will query for all V3 Organization objects
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#list-organizations
+func ListOrganizations(c *cfclient.Client) ([]Organization, error) {
+	orgs, _, err := listResources[Organization](c, "/v3/organizations", ListOptions{PerPage: maxPerPage})
+	return orgs, errors.Wrap(err, "Error requesting organizations")
+}
+
+// ListSpaces will query for all V3 Space objects matching the query filters, e.g. organization_guids
+// http://v3-apidocs.cloudfoundry.org/version/3.102.0/index.html#list-spaces
+func ListSpaces(c *cfclient.Client, filters url.Values) ([]Space, error) {
+	spaces, _, err := listResources[Space](c, "/v3/spaces", ListOptions{PerPage: maxPerPage, Filters: filters})
+	return spaces, errors.Wrap(err, "Error requesting spaces")
+}
+
+// getResource requests a V3 resource, or a page of them, and unmarshals it into v.
+func getResource(c *cfclient.Client, requestURL string, v interface{}) error {
+	r := c.NewRequest("GET", requestURL)
+	resp, err := c.DoRequest(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	resBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
 	}
-	return droplets, nil
+	return json.Unmarshal(resBody, v)
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+func TestListAppsIncludesSpaceAndOrg(t *testing.T) {
+	pages := map[string]string{
+		"1": `{
+			"pagination": {"next": {"href": "{{server}}/v3/apps?include=space.organization&page=2"}},
+			"resources": [{"guid": "app1", "name": "app-one", "relationships": {"space": {"data": {"guid": "space1"}}}}],
+			"included": {
+				"spaces": [{"guid": "space1", "name": "dev", "relationships": {"organization": {"data": {"guid": "org1"}}}}],
+				"organizations": [{"guid": "org1", "name": "sandbox"}]
+			}
+		}`,
+		"2": `{
+			"pagination": {"next": null},
+			"resources": [{"guid": "app2", "name": "app-two", "relationships": {"space": {"data": {"guid": "space2"}}}}],
+			"included": {
+				"spaces": [{"guid": "space2", "name": "staging", "relationships": {"organization": {"data": {"guid": "org2"}}}}],
+				"organizations": [{"guid": "org2", "name": "paid-org"}]
+			}
+		}`,
+	}
+	var serverURL string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/apps" || r.URL.Query().Get("include") != "space.organization" {
+			t.Fatalf("Unexpected request %s", r.URL)
+		}
+		page := r.URL.Query().Get("page")
+		if page == "" {
+			page = "1"
+		}
+		w.Write([]byte(strings.ReplaceAll(pages[page], "{{server}}", serverURL)))
+	}))
+	defer ts.Close()
+	serverURL = ts.URL
+	c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
+
+	apps, err := ListApps(&c, nil)
+	if err != nil {
+		t.Fatalf("Unable to list apps. Error: %s", err)
+	}
+	expected := []struct{ app, space, spaceGUID, org, orgGUID string }{
+		{"app-one", "dev", "space1", "sandbox", "org1"},
+		{"app-two", "staging", "space2", "paid-org", "org2"},
+	}
+	if len(apps) != len(expected) {
+		t.Fatalf("Expected %d apps, found %+v", len(expected), apps)
+	}
+	for i, e := range expected {
+		app := apps[i]
+		if app.Name != e.app || app.Space.Name != e.space || app.Space.GUID != e.spaceGUID ||
+			app.Org.Name != e.org || app.Org.GUID != e.orgGUID {
+			t.Errorf("Expected %s in space %s (%s) of org %s (%s), found %+v", e.app, e.space, e.spaceGUID, e.org, e.orgGUID, app)
+		}
+	}
+}
+
+// bodyTrackingTransport counts the response bodies which haven't been closed.
+type bodyTrackingTransport struct {
+	open int
+}
+
+func (t *bodyTrackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.open++
+	resp.Body = &trackedBody{ReadCloser: resp.Body, transport: t}
+	return resp, nil
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	transport *bodyTrackingTransport
+	closed    bool
+}
+
+func (b *trackedBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.transport.open--
+	}
+	return b.ReadCloser.Close()
+}
+
+func TestListResources(t *testing.T) {
+	transport := &bodyTrackingTransport{}
+	var serverURL string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if transport.open > 1 {
+			t.Errorf("Expected the body of each page to be closed before the next is requested, %d are open", transport.open)
+		}
+		query := r.URL.Query()
+		switch query.Get("page") {
+		case "":
+			expected := map[string]string{
+				"per_page":       "2",
+				"app_guids":      "app1,app2,app3",
+				"label_selector": "env=prod",
+				"include":        "user",
+			}
+			for key, value := range expected {
+				if query.Get(key) != value {
+					t.Errorf("Expected %s to be %q, found %q", key, value, query.Get(key))
+				}
+			}
+			fmt.Fprintf(w, `{"pagination": {"total_results": 3, "total_pages": 2, "next": {"href": "%s/v3/roles?page=2"}},
+				"resources": [{"guid": "role1"}, {"guid": "role2"}], "included": {"users": [{"guid": "user1"}]}}`, serverURL)
+		case "2":
+			fmt.Fprint(w, `{"pagination": {"total_results": 3, "total_pages": 2, "next": null},
+				"resources": [{"guid": "role3"}], "included": {"users": [{"guid": "user2"}]}}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	serverURL = ts.URL
+	c := cfclient.Client{Config: cfclient.Config{HttpClient: &http.Client{Transport: transport}, ApiAddress: ts.URL}}
+
+	var progress []int
+	roles, included, err := listResources[Role](&c, "/v3/roles", ListOptions{
+		PerPage:       2,
+		Filters:       url.Values{"app_guids": []string{"app1,app2,app3"}},
+		LabelSelector: "env=prod",
+		Include:       []string{"user"},
+		OnPage: func(listed int, pagination Pagination) {
+			progress = append(progress, listed)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to list resources. Error: %s", err)
+	}
+	if len(roles) != 3 || roles[2].GUID != "role3" {
+		t.Errorf("Expected the roles of both pages, found %+v", roles)
+	}
+	if len(included.Users) != 2 {
+		t.Errorf("Expected the included users of both pages, found %+v", included.Users)
+	}
+	if !reflect.DeepEqual(progress, []int{2, 3}) {
+		t.Errorf("Expected progress to be reported after each page, found %v", progress)
+	}
+	if transport.open != 0 {
+		t.Errorf("Expected all bodies to be closed, %d are open", transport.open)
+	}
+}
+
+func TestListResourcesReturnsPartialResults(t *testing.T) {
+	var serverURL string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"pagination": {"next": {"href": "%s/v3/buildpacks?page=2"}}, "resources": [{"guid": "bp1"}]}`, serverURL)
+	}))
+	defer ts.Close()
+	serverURL = ts.URL
+	c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
+
+	buildpacks, _, err := listResources[Buildpack](&c, "/v3/buildpacks", ListOptions{})
+	if err == nil {
+		t.Fatal("Expected an error when a page can't be got")
+	}
+	if !strings.Contains(err.Error(), "page 2") {
+		t.Errorf("Expected the error to say which page failed, found %s", err)
+	}
+	if len(buildpacks) != 1 || buildpacks[0].GUID != "bp1" {
+		t.Errorf("Expected the buildpacks of the first page, found %+v", buildpacks)
+	}
+}
@@ -13,8 +13,15 @@ OUT_STATE="$(pwd)/${OUT_STATE}"
 export IN_STATE
 export OUT_STATE
 
+if [ -n "${REPORT_FILE}" ]; then
+  REPORT_FILE="$(pwd)/${REPORT_FILE}"
+  export REPORT_FILE
+fi
+
 pushd gopath/src/github.com/cloud-gov/buildpack-notify
   go mod vendor
   go build
-  ./buildpack-notify
+  # Exit code 2 means some apps or recipients had errors, but the state was saved and they will be retried.
+  # The state still needs to be put, so don't fail the task.
+  ./buildpack-notify send || [ $? -eq 2 ]
 popd
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// defaultPreviewDir is where the preview command writes e-mails when PREVIEW_DIR isn't set.
+const defaultPreviewDir = "preview"
+
+const usage = `Usage: buildpack-notify <command> [flags]
+
+Commands:
+  send                      Notify the owners of outdated apps and save the state. This is the default.
+  check                     List the apps using outdated buildpacks. Nothing is sent and the state isn't used.
+  preview                   Write the e-mails which would be sent to .eml files in -preview-dir instead of sending them.
+  serve                     Run send on -schedule and serve /health and /metrics until stopped.
+  state show                Print the saved state.
+  state reset               Replace the saved state with empty state.
+  state forget <buildpack>  Forget the updates and notifications of a buildpack, given its name or GUID,
+                            so the next run handles its current release again.
+  state snooze <app> <buildpack> <date>
+                            Send no reminders about an app, given its GUID, being outdated by the last update
+                            of a buildpack until the end of the date, e.g. 2006-01-02.
+
+Each setting other than the SMTP and CF API credentials can be given as a flag named after its environment
+variable, e.g. -dry-run for DRY_RUN. Flags override the environment. Run buildpack-notify <command> -h to list them.
+`
+
+// runCommand runs the command in the arguments and returns the exit code.
+func runCommand(args []string, w io.Writer) int {
+	command := "send"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "send":
+		return sendCommand(args, false)
+	case "preview":
+		return sendCommand(args, true)
+	case "check":
+		return checkCommand(args, w)
+	case "serve":
+		return serveCommand(args)
+	case "state":
+		return stateCommand(args, w)
+	case "help":
+		fmt.Fprint(w, usage)
+		return exitSuccess
+	}
+	log.Printf("Unknown command %q\n", command)
+	fmt.Fprint(os.Stderr, usage)
+	return exitFailure
+}
+
+// sendCommand notifies the owners of outdated apps, or only writes the e-mails to files for a preview.
+func sendCommand(args []string, preview bool) int {
+	var (
+		config      Config
+		cfAPIConfig CFAPIConfig
+	)
+	name := "send"
+	if preview {
+		name = "preview"
+	}
+	if _, code, ok := parseConfig(flag.NewFlagSet(name, flag.ContinueOnError), args, &config); !ok {
+		return code
+	}
+	if preview && config.PreviewDir == "" {
+		config.PreviewDir = defaultPreviewDir
+	}
+	emailConfig, err := loadEmailConfig(config)
+	if err != nil {
+		log.Printf("Unable to parse email config: %s\n", err)
+		return exitFailure
+	}
+	if err := envconfig.Process("", &cfAPIConfig); err != nil {
+		log.Printf("Unable to parse cf api config: %s\n", err)
+		return exitFailure
+	}
+	result, err := run(config, emailConfig, cfAPIConfig)
+	return finishRun(config, result, err)
+}
+
+// serveCommand runs send on the schedule until it gets SIGINT or SIGTERM. Runs never overlap.
+func serveCommand(args []string) int {
+	var (
+		config      Config
+		cfAPIConfig CFAPIConfig
+	)
+	if _, code, ok := parseConfig(flag.NewFlagSet("serve", flag.ContinueOnError), args, &config); !ok {
+		return code
+	}
+	if config.StateStore == filePairStateStore {
+		log.Printf("STATE_STORE is %s, which can't be used with serve because every run would read the same state. "+
+			"Set STATE_STORE to %s, %s or %s\n", filePairStateStore, fileStateStore, sqliteStateStore, postgresStateStore)
+		return exitFailure
+	}
+	s, err := parseSchedule(config.Schedule)
+	if err != nil {
+		log.Printf("Unable to parse config: %s\n", err)
+		return exitFailure
+	}
+	emailConfig, err := loadEmailConfig(config)
+	if err != nil {
+		log.Printf("Unable to parse email config: %s\n", err)
+		return exitFailure
+	}
+	if err := envconfig.Process("", &cfAPIConfig); err != nil {
+		log.Printf("Unable to parse cf api config: %s\n", err)
+		return exitFailure
+	}
+	service := newService(s, func() int {
+		result, err := run(config, emailConfig, cfAPIConfig)
+		return finishRun(config, result, err)
+	})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := serve(ctx, ":"+config.Port, service); err != nil {
+		log.Printf("Unable to serve: %s\n", err)
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+// checkCommand lists the apps using outdated buildpacks.
+func checkCommand(args []string, w io.Writer) int {
+	var (
+		config      Config
+		cfAPIConfig CFAPIConfig
+	)
+	if _, code, ok := parseConfig(flag.NewFlagSet("check", flag.ContinueOnError), args, &config); !ok {
+		return code
+	}
+	if err := envconfig.Process("", &cfAPIConfig); err != nil {
+		log.Printf("Unable to parse cf api config: %s\n", err)
+		return exitFailure
+	}
+	result, err := check(config, cfAPIConfig, w)
+	return finishRun(config, result, err)
+}
+
+// stateCommand shows or changes the saved state.
+func stateCommand(args []string, w io.Writer) int {
+	if len(args) == 0 {
+		log.Println("Missing state command")
+		fmt.Fprint(os.Stderr, usage)
+		return exitFailure
+	}
+	var config Config
+	subcommand, args := args[0], args[1:]
+	args, code, ok := parseConfig(flag.NewFlagSet("state "+subcommand, flag.ContinueOnError), args, &config)
+	if !ok {
+		return code
+	}
+	store, err := newStateStore(config)
+	if err != nil {
+		log.Printf("Unable to create state store: %s\n", err)
+		return exitFailure
+	}
+	defer store.Close()
+
+	switch subcommand {
+	case "show":
+		state, err := store.Load()
+		if err != nil {
+			log.Printf("Error reading state: %s\n", err)
+			return exitFailure
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(state); err != nil {
+			log.Printf("Unable to print state: %s\n", err)
+			return exitFailure
+		}
+		return exitSuccess
+	case "reset":
+		if err := store.Save(newSavedState()); err != nil {
+			log.Printf("Error saving state: %s\n", err)
+			return exitFailure
+		}
+		log.Println("State reset")
+		return exitSuccess
+	case "forget":
+		if len(args) != 1 {
+			log.Println("state forget needs the name or GUID of a buildpack")
+			return exitFailure
+		}
+		state, err := store.Load()
+		if err != nil {
+			log.Printf("Error reading state: %s\n", err)
+			return exitFailure
+		}
+		guids, err := resolveBuildpackGUIDs(args[0], state)
+		if err != nil {
+			log.Printf("Unable to find buildpack %s: %s\n", args[0], err)
+			return exitFailure
+		}
+		for _, guid := range guids {
+			state.forgetBuildpack(guid)
+			log.Printf("Forgot buildpack GUID %s\n", guid)
+		}
+		if err := store.Save(state); err != nil {
+			log.Printf("Error saving state: %s\n", err)
+			return exitFailure
+		}
+		return exitSuccess
+	case "snooze":
+		if len(args) != 3 {
+			log.Println("state snooze needs the GUID of an app, the name or GUID of a buildpack and a date")
+			return exitFailure
+		}
+		appGUID, buildpack, until := args[0], args[1], args[2]
+		if _, err := snoozeExpiresAt(until); err != nil {
+			log.Printf("Invalid date %s, it must be like %s\n", until, snoozeDateLayout)
+			return exitFailure
+		}
+		state, err := store.Load()
+		if err != nil {
+			log.Printf("Error reading state: %s\n", err)
+			return exitFailure
+		}
+		guids, err := resolveBuildpackGUIDs(buildpack, state)
+		if err != nil {
+			log.Printf("Unable to find buildpack %s: %s\n", buildpack, err)
+			return exitFailure
+		}
+		snoozed := 0
+		for _, guid := range guids {
+			record, found := state.Buildpacks[guid]
+			if !found {
+				continue
+			}
+			state.snooze(appGUID, guid, record.LastUpdatedAt, until, time.Now())
+			log.Printf("Snoozed reminders about app %s and buildpack GUID %s until %s\n", appGUID, guid, until)
+			snoozed++
+		}
+		if snoozed == 0 {
+			log.Printf("No update of buildpack %s has been handled yet\n", buildpack)
+			return exitFailure
+		}
+		if err := store.Save(state); err != nil {
+			log.Printf("Error saving state: %s\n", err)
+			return exitFailure
+		}
+		return exitSuccess
+	}
+	log.Printf("Unknown state command %q\n", subcommand)
+	fmt.Fprint(os.Stderr, usage)
+	return exitFailure
+}
+
+// parseConfig parses the flags of a command and then the config, so the flags which were set override the
+// environment. Flags can come before or after the other arguments, which are returned. It returns false with the
+// exit code if the command shouldn't carry on.
+func parseConfig(fs *flag.FlagSet, args []string, config *Config) ([]string, int, bool) {
+	flags := addConfigFlags(fs, config)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, exitSuccess, false
+		}
+		return nil, exitFailure, false
+	}
+	if err := envconfig.Process("", config); err != nil {
+		log.Printf("Unable to parse config: %s\n", err)
+		return nil, exitFailure, false
+	}
+	applyConfigFlags(flags, config)
+	if err := validateConfig(*config); err != nil {
+		log.Printf("Unable to parse config: %s\n", err)
+		return nil, exitFailure, false
+	}
+	return args, exitSuccess, true
+}
+
+// parseFlags parses the flags anywhere in the arguments, e.g. after the app and buildpack of state snooze, and
+// returns the other arguments in order. Everything after "--" is an argument.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if parsed := len(args) - len(rest); parsed > 0 && args[parsed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// configFlag is a flag for a setting in the config. Its value is parsed like the setting's environment variable
+// and kept until it is copied onto the config with applyConfigFlags, so the environment isn't changed.
+type configFlag struct {
+	index int
+	value reflect.Value
+	set   bool
+}
+
+func (f *configFlag) String() string {
+	return ""
+}
+
+func (f *configFlag) Set(value string) error {
+	if err := setConfigField(f.value, value); err != nil {
+		return err
+	}
+	f.set = true
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.value.Kind() == reflect.Bool
+}
+
+// addConfigFlags adds a flag for each setting in the config spec, named after its environment variable,
+// e.g. -dry-run for DRY_RUN.
+func addConfigFlags(fs *flag.FlagSet, spec interface{}) []*configFlag {
+	var flags []*configFlag
+	t := reflect.TypeOf(spec).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("envconfig")
+		if key == "" {
+			continue
+		}
+		key = strings.ToUpper(key)
+		name := strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+		f := &configFlag{index: i, value: reflect.New(field.Type).Elem()}
+		fs.Var(f, name, "overrides "+key)
+		flags = append(flags, f)
+	}
+	return flags
+}
+
+// applyConfigFlags copies the values of the flags which were set onto the config spec.
+func applyConfigFlags(flags []*configFlag, spec interface{}) {
+	v := reflect.ValueOf(spec).Elem()
+	for _, f := range flags {
+		if f.set {
+			v.Field(f.index).Set(f.value)
+		}
+	}
+}
+
+// setConfigField parses the value into the field the way envconfig parses environment variables. Lists are
+// separated by commas.
+func setConfigField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Slice:
+		list := reflect.MakeSlice(field.Type(), 0, 0)
+		if strings.TrimSpace(value) != "" {
+			items := strings.Split(value, ",")
+			list = reflect.MakeSlice(field.Type(), len(items), len(items))
+			for i, item := range items {
+				if err := setConfigField(list.Index(i), item); err != nil {
+					return err
+				}
+			}
+		}
+		field.Set(list)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// loadEmailConfig parses the email config. Nothing is sent in preview mode, so only the sender is needed.
+func loadEmailConfig(config Config) (EmailConfig, error) {
+	var emailConfig EmailConfig
+	if config.PreviewDir != "" {
+		emailConfig.From = os.Getenv("SMTP_FROM")
+		return emailConfig, nil
+	}
+	err := envconfig.Process("", &emailConfig)
+	return emailConfig, err
+}
+
+// finishRun logs the outcome of a run, writes its report and gets its exit code.
+func finishRun(config Config, result *runResult, err error) int {
+	exitCode := exitFailure
+	if err != nil {
+		log.Printf("Run failed: %s\n", err)
+	} else {
+		for _, err := range result.Errors {
+			log.Printf("Error: %s\n", err)
+		}
+		exitCode = result.exitCode()
+	}
+	result.Report.finish(result, err, exitCode)
+	if config.ReportFile != "" {
+		if err := result.Report.write(config.ReportFile); err != nil {
+			log.Printf("Unable to write run report: %s\n", err)
+		}
+	}
+	appMetrics.observeRun(result.Report, exitCode, time.Now())
+	if config.MetricsFile != "" {
+		if err := appMetrics.writeFile(config.MetricsFile); err != nil {
+			log.Printf("Unable to write metrics: %s\n", err)
+		}
+	}
+	return exitCode
+}
+
+// resolveBuildpackGUIDs gets the GUIDs of a buildpack given its GUID or name. Names are looked up in the CF API,
+// and there may be a buildpack with the name for each stack.
+func resolveBuildpackGUIDs(buildpack string, state *savedState) ([]string, error) {
+	if state.knowsBuildpack(buildpack) {
+		return []string{buildpack}, nil
+	}
+	var cfAPIConfig CFAPIConfig
+	if err := envconfig.Process("", &cfAPIConfig); err != nil {
+		return nil, fmt.Errorf("it isn't a known buildpack GUID and the cf api config is needed to look up its name: %s", err)
+	}
+	client, err := newCFClient(cfAPIConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client: %s", err)
+	}
+	buildpacks, err := ListBuildpacks(client)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get buildpacks: %s", err)
+	}
+	var guids []string
+	for _, b := range buildpacks {
+		if b.Name == buildpack || b.GUID == buildpack {
+			guids = append(guids, b.GUID)
+		}
+	}
+	if len(guids) == 0 {
+		return nil, fmt.Errorf("no buildpack has that name or GUID")
+	}
+	return guids, nil
+}
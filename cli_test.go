@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigFlagsOverrideEnvironment(t *testing.T) {
+	t.Setenv("STATE_STORE", "file")
+	t.Setenv("STATE_FILE", "env.json")
+	t.Setenv("DRY_RUN", "false")
+	t.Setenv("REMINDER_DAYS", "30")
+
+	var config Config
+	args := []string{"-state-file", "flag.json", "extra", "-dry-run", "-reminder-days", "7,14", "more", "--", "-last"}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	args, code, ok := parseConfig(fs, args, &config)
+	if !ok {
+		t.Fatalf("Unable to parse config. Exit code %d", code)
+	}
+	if config.StateStore != fileStateStore || config.StateFile != "flag.json" || !config.DryRun {
+		t.Errorf("Expected the flags to override the environment. Actual %+v", config)
+	}
+	if !reflect.DeepEqual(config.ReminderDays, []int{7, 14}) {
+		t.Errorf("Expected reminder days to be parsed like the environment. Actual %v", config.ReminderDays)
+	}
+	if !reflect.DeepEqual(config.NotifyRoles, []string{"space_manager", "space_developer"}) {
+		t.Errorf("Expected defaults to be kept. Actual %v", config.NotifyRoles)
+	}
+	if !reflect.DeepEqual(args, []string{"extra", "more", "-last"}) {
+		t.Errorf("Expected the arguments between and after the flags to be kept. Actual %v", args)
+	}
+	if os.Getenv("STATE_FILE") != "env.json" || os.Getenv("DRY_RUN") != "false" {
+		t.Errorf("Expected the flags not to change the environment. Actual STATE_FILE=%s DRY_RUN=%s", os.Getenv("STATE_FILE"), os.Getenv("DRY_RUN"))
+	}
+}
+
+func TestRunCommandErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		args []string
+	}{
+		{"unknown command", []string{"notify"}},
+		{"unknown flag", []string{"send", "-notify"}},
+		{"invalid flag value", []string{"send", "-concurrency", "many"}},
+		{"serve with the files state store", []string{"serve", "-state-store", "files"}},
+		{"missing state command", []string{"state"}},
+		{"unknown state command", []string{"state", "drop", "-state-store", "file", "-state-file", "state.json"}},
+		{"forget without buildpack", []string{"state", "forget", "-state-store", "file", "-state-file", "state.json"}},
+		{"snooze without date", []string{"state", "snooze", "-state-store", "file", "-state-file", "state.json", "app1", "python-guid"}},
+		{"snooze until invalid date", []string{"state", "snooze", "-state-store", "file", "-state-file", "state.json", "app1", "python-guid", "next week"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := runCommand(tc.args, &bytes.Buffer{}); code != exitFailure {
+				t.Errorf("Test %s failed. Expected exit code %d, found %d", tc.name, exitFailure, code)
+			}
+		})
+	}
+}
+
+func TestStateCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	t.Setenv("STATE_STORE", fileStateStore)
+	t.Setenv("STATE_FILE", path)
+	store := &fileStore{path: path}
+
+	state := newSavedState()
+	state.Buildpacks["python-guid"] = buildpackRecord{LastUpdatedAt: "2016-06-08T16:41:45Z"}
+	state.Buildpacks["ruby-guid"] = buildpackRecord{LastUpdatedAt: "2016-06-08T16:41:45Z"}
+	state.recordNotification(user1, notifyApp{App: App{GUID: "app1"}, Buildpack: buildpackReleaseInfo{BuildpackGUID: "python-guid"}}, nil)
+	state.recordNotification(user1, notifyApp{App: App{GUID: "app2"}, Buildpack: buildpackReleaseInfo{BuildpackGUID: "ruby-guid"}}, nil)
+	if err := store.Save(state); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if code := runCommand([]string{"state", "show"}, &out); code != exitSuccess {
+		t.Fatalf("Expected state show to succeed, found exit code %d", code)
+	}
+	var shown savedState
+	if err := json.Unmarshal(out.Bytes(), &shown); err != nil || len(shown.Buildpacks) != 2 {
+		t.Errorf("Expected the state to be shown. Actual %s", out.String())
+	}
+
+	// Flags can come after the arguments.
+	if code := runCommand([]string{"state", "snooze", "app2", "ruby-guid", "2016-07-01", "-state-file", path}, &out); code != exitSuccess {
+		t.Fatalf("Expected state snooze to succeed, found exit code %d", code)
+	}
+	if code := runCommand([]string{"state", "snooze", "app2", "unknown-guid", "2016-07-01"}, &out); code != exitFailure {
+		t.Errorf("Expected state snooze of an unknown buildpack to fail, found exit code %d", code)
+	}
+	snoozed, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snooze := snoozed.Snoozes[appReleaseKey("app2", "ruby-guid", "2016-06-08T16:41:45Z")]
+	if len(snoozed.Snoozes) != 1 || snooze.Until != "2016-07-01" {
+		t.Errorf("Expected reminders about app2 to be snoozed. Actual %+v", snoozed.Snoozes)
+	}
+
+	if code := runCommand([]string{"state", "forget", "python-guid"}, &out); code != exitSuccess {
+		t.Fatalf("Expected state forget to succeed, found exit code %d", code)
+	}
+	forgotten, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := forgotten.Buildpacks["python-guid"]; found || len(forgotten.Buildpacks) != 1 || len(forgotten.Notifications) != 1 || len(forgotten.Snoozes) != 1 {
+		t.Errorf("Expected only the python buildpack to be forgotten. Actual %+v", forgotten)
+	}
+
+	if code := runCommand([]string{"state", "reset"}, &out); code != exitSuccess {
+		t.Fatalf("Expected state reset to succeed, found exit code %d", code)
+	}
+	reset, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reset.Buildpacks) != 0 || len(reset.Notifications) != 0 {
+		t.Errorf("Expected the state to be empty. Actual %+v", reset)
+	}
+}
+
+func TestPrintOutdatedApps(t *testing.T) {
+	now := time.Date(2016, 1, 11, 0, 0, 0, 0, time.UTC)
+	apps := []notifyApp{{
+		App:              App{Name: "my-app", Space: Space{Name: "dev"}, Org: Organization{Name: "my-org"}},
+		Buildpack:        buildpackReleaseInfo{BuildpackName: "python_buildpack", BuildpackVersion: "v1.7.43"},
+		DropletCreatedAt: "2016-01-01T00:00:00Z",
+	}}
+	var out bytes.Buffer
+	if err := printOutdatedApps(&out, apps, now); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || strings.Join(strings.Fields(lines[1]), " ") != "my-org dev my-app python_buildpack v1.7.43 10" {
+		t.Errorf("Unexpected table %q", out.String())
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloud-gov/buildpack-notify/message"
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+// getEscalationRoles returns the org roles which receive escalations.
+func getEscalationRoles(includeBillingManagers bool) []string {
+	roles := []string{orgManagerRole}
+	if includeBillingManagers {
+		roles = append(roles, orgBillingManagerRole)
+	}
+	return roles
+}
+
+// orgRoleTypes maps the org recipient roles to their types in the V3 API.
+var orgRoleTypes = map[string]string{
+	orgManagerRole:        "organization_manager",
+	orgBillingManagerRole: "organization_billing_manager",
+	orgAuditorRole:        "organization_auditor",
+}
+
+// loadOrgUsers gets the users with any of the roles in the orgs. The supported roles are org_manager,
+// org_billing_manager and org_auditor. As with loadSpaceUsers, the roles of a batch of orgs and their users are got
+// together. It returns an error for each org whose users couldn't be got.
+func (c *cfSpaceCache) loadOrgUsers(orgGUIDs []string, roles []string, client *cfclient.Client, concurrency int) map[string]error {
+	orgErrs := make(map[string]error)
+	var types []string
+	for _, role := range roles {
+		roleType, found := orgRoleTypes[role]
+		if !found {
+			for _, orgGUID := range orgGUIDs {
+				orgErrs[orgGUID] = fmt.Errorf("unknown org role %s", role)
+			}
+			return orgErrs
+		}
+		types = append(types, roleType)
+	}
+	sort.Strings(types)
+	batches := batchGUIDs(orgGUIDs)
+	batchErrs := make([]error, len(batches))
+	forEachConcurrently(len(batches), concurrency, func(i int) {
+		batchErrs[i] = c.loadOrgUsersBatch(batches[i], roles, types, client)
+	})
+	for i, batch := range batches {
+		if batchErrs[i] == nil {
+			continue
+		}
+		for _, orgGUID := range batch {
+			orgErrs[orgGUID] = batchErrs[i]
+		}
+	}
+	return orgErrs
+}
+
+func (c *cfSpaceCache) loadOrgUsersBatch(orgGUIDs []string, roles []string, types []string, client *cfclient.Client) error {
+	roleResources, usersByGUID, err := ListRolesByQuery(client, url.Values{
+		"organization_guids": []string{strings.Join(orgGUIDs, ",")},
+		"types":              []string{strings.Join(types, ",")},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get users with roles in orgs: %s", err)
+	}
+	orgUsers := make(map[string][]User)
+	for _, orgGUID := range orgGUIDs {
+		for _, role := range roles {
+			orgUsers[orgGUID+"|"+role] = nil
+		}
+	}
+	for _, r := range roleResources {
+		user, found := usersByGUID[r.Relationships.User.Data.GUID]
+		if !found {
+			continue
+		}
+		for _, role := range roles {
+			if orgRoleTypes[role] != r.Type {
+				continue
+			}
+			key := r.Relationships.Organization.Data.GUID + "|" + role
+			if _, found := orgUsers[key]; found {
+				orgUsers[key] = append(orgUsers[key], user)
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, users := range orgUsers {
+		c.orgUsers[key] = users
+	}
+	return nil
+}
+
+// getUsernamesWithOrgRoles gets the usernames of the users from the allowed origins with any of the roles in the
+// app's org which are valid e-mail addresses, once loadOrgUsers has got them.
+func (c *cfSpaceCache) getUsernamesWithOrgRoles(app notifyApp, roles []string) []string {
+	orgGUID := app.Org.GUID
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var usernames []string
+	for _, role := range roles {
+		for _, user := range c.orgUsers[orgGUID+"|"+role] {
+			if !c.allowsOrigin(user.Origin) {
+				continue
+			}
+			if _, err := mail.ParseAddress(user.Username); err != nil {
+				log.Printf("Dropping e-mail to user %s about app %s in org %s because "+
+					"invalid e-mail address\n", user.Username, app.Name, orgGUID)
+				continue
+			}
+			usernames = append(usernames, user.Username)
+		}
+	}
+	return usernames
+}
+
+// getOrgGUIDsOfApps gets the sorted GUIDs of the orgs the apps are in.
+func getOrgGUIDsOfApps(apps []notifyApp) []string {
+	var orgGUIDs []string
+	seen := make(map[string]bool)
+	for _, app := range apps {
+		if !seen[app.Org.GUID] {
+			seen[app.Org.GUID] = true
+			orgGUIDs = append(orgGUIDs, app.Org.GUID)
+		}
+	}
+	sort.Strings(orgGUIDs)
+	return orgGUIDs
+}
+
+// filterForLaggingApps gets the outdated apps whose owners were first notified more than escalationDays ago.
+func filterForLaggingApps(apps []notifyApp, state *savedState, escalationDays int, now time.Time) []notifyApp {
+	var laggingApps []notifyApp
+	if escalationDays <= 0 {
+		return laggingApps
+	}
+	firstNotified := state.firstNotifiedTimes()
+	for _, app := range apps {
+		firstNotifiedAt, found := firstNotified[appReleaseKey(app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)]
+		if !found || now.Sub(firstNotifiedAt) < time.Duration(escalationDays)*24*time.Hour {
+			continue
+		}
+		app.DropletAgeDays = dropletAgeDays(app.DropletCreatedAt, now)
+		laggingApps = append(laggingApps, app)
+	}
+	return laggingApps
+}
+
+// findOrgManagersOfApps maps the users from the origins with any of the roles in each app's org to the apps.
+// Users from any origin are included when origins is empty.
+// Apps whose org managers can't be found are left out and an error is returned for each of them.
+func findOrgManagersOfApps(apps []notifyApp, roles []string, origins []string, client *cfclient.Client, concurrency int) (map[string][]notifyApp, error) {
+	managers := make(map[string][]notifyApp)
+	var errs []error
+	cache := createCFSpaceCache(origins)
+	orgErrs := cache.loadOrgUsers(getOrgGUIDsOfApps(apps), roles, client, concurrency)
+	for _, app := range apps {
+		if err := orgErrs[app.Org.GUID]; err != nil {
+			errs = append(errs, &appError{app.GUID, app.Name, "find org managers of", err})
+			continue
+		}
+		usernames := make(map[string]bool)
+		for _, username := range cache.getUsernamesWithOrgRoles(app, roles) {
+			usernames[username] = true
+		}
+		for username := range usernames {
+			managers[username] = append(managers[username], app)
+		}
+	}
+	return managers, errors.Join(errs...)
+}
+
+// sendEscalationEmailToUsers tells org managers about every lagging app in their orgs, but only when at least one
+// of the apps hasn't been escalated to them yet or a previous escalation to them failed.
+// It returns the number of e-mails sent and an error for each e-mail which couldn't be sent.
+func sendEscalationEmailToUsers(users map[string][]notifyApp, templates *Templates, mailer Mailer, state *savedState, escalationDays int, dryRun bool) (int, error) {
+	sent := 0
+	var errs []error
+	escalatedApps := state.escalatedApps()
+	for _, user := range sortedRecipients(users) {
+		apps := users[user]
+		if !isEscalationDue(user, apps, state, escalatedApps) {
+			continue
+		}
+		sort.SliceStable(apps, func(i, j int) bool {
+			return apps[i].DropletAgeDays > apps[j].DropletAgeDays
+		})
+		body := new(bytes.Buffer)
+		email := newNotifyEmail(user, apps)
+		if err := templates.getEscalationEmail(body, escalationEmail{email.Username, email.Apps, email.IsMultipleApp, email.Buildpacks, escalationDays}); err != nil {
+			if !dryRun {
+				for _, app := range apps {
+					state.recordEscalation(user, app, err)
+				}
+			}
+			errs = append(errs, fmt.Errorf("unable to fill in escalation e-mail to %s: %s", user, err))
+			continue
+		}
+		if !dryRun {
+			subj := "Action required: application in your organization still needs restaging"
+			if email.IsMultipleApp {
+				subj = "Action required: applications in your organization still need restaging"
+			}
+			err := mailer.SendEmail(message.Email{To: user, Subject: subj, Text: body.Bytes()})
+			for _, app := range apps {
+				state.recordEscalation(user, app, err)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to send escalation e-mail to %s: %s", user, err))
+				continue
+			}
+		}
+		fmt.Printf("Sent escalation e-mail to %s\n", user)
+		sent++
+	}
+	return sent, errors.Join(errs...)
+}
+
+// isEscalationDue checks whether the user needs to be told about any of the apps.
+// As with notifications, users without a record for an app which was already escalated to others are not told.
+func isEscalationDue(user string, apps []notifyApp, state *savedState, escalatedApps map[string]bool) bool {
+	for _, app := range apps {
+		key := notificationKey(user, app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)
+		if record, found := state.Escalations[key]; found {
+			if record.SentAt == "" {
+				return true
+			}
+		} else if !escalatedApps[appReleaseKey(app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloud-gov/buildpack-notify/message"
+	"github.com/cloud-gov/buildpack-notify/mocks"
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestEscalationState(now time.Time, notifiedDaysAgo int) *savedState {
+	state := newSavedState()
+	state.Notifications[notificationKey(user1, "app1", "python-guid", "2016-06-08T16:41:45Z")] = notificationRecord{
+		Recipient: user1, AppGUID: "app1", BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z",
+		Attempts: 1, SentAt: now.Add(-time.Duration(notifiedDaysAgo) * 24 * time.Hour).UTC().Format(time.RFC3339),
+	}
+	return state
+}
+
+func TestFilterForLaggingApps(t *testing.T) {
+	now := time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+	app := notifyApp{
+		App:              App{GUID: "app1"},
+		Buildpack:        buildpackReleaseInfo{BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"},
+		DropletCreatedAt: "2019-12-01T12:00:00Z",
+	}
+	otherApp := notifyApp{
+		App:       App{GUID: "app2"},
+		Buildpack: buildpackReleaseInfo{BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"},
+	}
+	testCases := []struct {
+		name            string
+		notifiedDaysAgo int
+		escalationDays  int
+		expected        int
+	}{
+		{"escalation disabled", 40, 0, 0},
+		{"not lagging yet", 10, 30, 0},
+		{"lagging", 40, 30, 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := newTestEscalationState(now, tc.notifiedDaysAgo)
+			laggingApps := filterForLaggingApps([]notifyApp{app, otherApp}, state, tc.escalationDays, now)
+			if len(laggingApps) != tc.expected {
+				t.Fatalf("Test %s failed. Expected %d lagging apps, found %d", tc.name, tc.expected, len(laggingApps))
+			}
+			if tc.expected > 0 && laggingApps[0].DropletAgeDays != 61 {
+				t.Errorf("Test %s failed. Expected droplet age of 61 days, found %d", tc.name, laggingApps[0].DropletAgeDays)
+			}
+			if due := state.hasDueEscalations("python-guid", "2016-06-08T16:41:45Z", tc.escalationDays, now, state.firstNotifiedTimes(), state.escalatedApps(), state.pendingEscalations()); due != (tc.expected > 0) {
+				t.Errorf("Test %s failed. Expected escalations due to be %v", tc.name, tc.expected > 0)
+			}
+		})
+	}
+}
+
+func TestFindOrgManagersOfApps(t *testing.T) {
+	// The users with each role in each org.
+	users := map[string]map[string][]User{
+		"org1": {
+			"organization_manager": {
+				{GUID: user1GUID, Username: user1, Origin: "uaa"},
+				{GUID: "admin-guid", Username: "admin", Origin: "uaa"},
+			},
+			"organization_billing_manager": {
+				{GUID: user2GUID, Username: user2, Origin: "sso"},
+			},
+		},
+		"org2": {
+			"organization_manager": {
+				{GUID: "manager-guid", Username: "manager@example.com", Origin: "sso"},
+			},
+		},
+	}
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		query := r.URL.Query()
+		if r.URL.Path != "/v3/roles" || query.Get("organization_guids") == "" || query.Get("include") != "user" {
+			t.Fatalf("Unable to find handler for %s", r.URL)
+		}
+		var resp ListResponse[Role]
+		for _, orgGUID := range strings.Split(query.Get("organization_guids"), ",") {
+			for _, roleType := range strings.Split(query.Get("types"), ",") {
+				for _, user := range users[orgGUID][roleType] {
+					role := Role{GUID: user.GUID + "-" + orgGUID + "-role", Type: roleType}
+					role.Relationships.User.Data.GUID = user.GUID
+					role.Relationships.Organization.Data.GUID = orgGUID
+					resp.Resources = append(resp.Resources, role)
+					resp.Included.Users = append(resp.Included.Users, user)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+	c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
+	apps := []notifyApp{
+		{App: App{GUID: "app1", Org: Organization{GUID: "org1"}}},
+		{App: App{GUID: "app2", Org: Organization{GUID: "org2"}}},
+		{App: App{GUID: "app3", Org: Organization{GUID: "org1"}}},
+	}
+
+	testCases := []struct {
+		name     string
+		roles    []string
+		origins  []string
+		expected map[string]int
+	}{
+		{"org managers", getEscalationRoles(false), nil, map[string]int{user1: 2, "manager@example.com": 1}},
+		{"billing managers", getEscalationRoles(true), nil, map[string]int{user1: 2, user2: 2, "manager@example.com": 1}},
+		{"uaa users", getEscalationRoles(true), []string{"uaa"}, map[string]int{user1: 2}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			managers, err := findOrgManagersOfApps(apps, tc.roles, tc.origins, &c, 4)
+			if err != nil {
+				t.Fatalf("Test %s failed. Unable to find org managers. Error: %s", tc.name, err.Error())
+			}
+			actual := make(map[string]int)
+			for username, managedApps := range managers {
+				actual[username] = len(managedApps)
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("Test %s failed. Expected %v Actual %v", tc.name, tc.expected, actual)
+			}
+			if requests != 1 {
+				t.Errorf("Test %s failed. Expected the roles of both orgs to be got in 1 request, found %d", tc.name, requests)
+			}
+		})
+	}
+}
+
+func TestSendEscalationEmailToUsers(t *testing.T) {
+	now := time.Now()
+	state := newTestEscalationState(now, 40)
+	app := notifyApp{
+		App:            App{GUID: "app1", Name: "testapp"},
+		Buildpack:      buildpackReleaseInfo{BuildpackName: "python_buildpack", BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"},
+		DropletAgeDays: 61,
+	}
+	managers := map[string][]notifyApp{user2: {app}}
+	templates, _ := initTemplates()
+
+	mockMailer := new(mocks.Mailer)
+	mockMailer.On("SendEmail", mock.MatchedBy(func(email message.Email) bool {
+		return email.To == user2 && email.Subject == "Action required: application in your organization still needs restaging"
+	})).Return(nil)
+	sendEscalationEmailToUsers(managers, templates, mockMailer, state, 30, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 1)
+	if state.hasDueEscalations("python-guid", "2016-06-08T16:41:45Z", 30, now, state.firstNotifiedTimes(), state.escalatedApps(), state.pendingEscalations()) {
+		t.Error("Expected no escalations to be due after sending")
+	}
+
+	// Managers are only told about an app once.
+	mockMailer = new(mocks.Mailer)
+	sendEscalationEmailToUsers(managers, templates, mockMailer, state, 30, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 0)
+
+	// A failed escalation makes escalations due again so it is retried.
+	state.recordEscalation("user3@example.com", app, errors.New("smtp down"))
+	if !state.hasDueEscalations("python-guid", "2016-06-08T16:41:45Z", 30, now, state.firstNotifiedTimes(), state.escalatedApps(), state.pendingEscalations()) {
+		t.Error("Expected escalations to be due after a failed escalation")
+	}
+}
@@ -49,7 +49,7 @@ pushd app || exit 1
 
   # Run buildpack notify app
   pushd ../../
-    go build && ./cg-buildpack-notify -notify > log.txt
+    go build && ./buildpack-notify send > log.txt
     ## show the log.
     echo "Showing run log.."
     cat log.txt
@@ -70,7 +70,7 @@ pushd app || exit 1
 
   # Run buildpack notify app
   pushd ../../
-    go build && ./cg-buildpack-notify -notify > log.txt
+    go build && ./buildpack-notify send > log.txt
     ## show the log.
     echo "Showing run log.."
     cat log.txt
@@ -91,7 +91,7 @@ pushd app || exit 1
 
   # Run buildpack notify app
   pushd ../../
-    go build && ./cg-buildpack-notify -notify > log.txt
+    go build && ./buildpack-notify send > log.txt
     ## show the log.
     echo "Showing run log.."
     cat log.txt
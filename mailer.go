@@ -3,14 +3,20 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
+	"html/template"
 	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
 
+	"github.com/cloud-gov/buildpack-notify/message"
 	"github.com/jordan-wright/email"
 )
 
 // Mailer is a interface that any mailer should implement.
 type Mailer interface {
-	SendEmail(emailAddress string, subject string, body []byte) error
+	SendEmail(email message.Email) error
 }
 
 // InitSMTPMailer creates a new SMTP Mailer
@@ -44,13 +50,10 @@ type smtpMailer struct {
 	tlsConfig *tls.Config
 }
 
-func (s *smtpMailer) SendEmail(emailAddress, subject string, body []byte) error {
-	e := email.NewEmail()
-	e.From = "cloud.gov <" + s.smtpFrom + ">"
-	e.To = []string{" <" + emailAddress + ">"}
-	e.Text = body
-	e.Subject = subject
-
+// SendEmail sends the e-mail. When it has an HTML body, it is sent as multipart/alternative
+// so clients which can't show HTML fall back to the plain-text body.
+func (s *smtpMailer) SendEmail(msg message.Email) error {
+	e := newEmail(s.smtpFrom, msg)
 	addr := s.smtpHost + ":" + s.smtpPort
 	auth := smtp.PlainAuth("", s.smtpUser, s.smtpPass, s.smtpHost)
 
@@ -59,3 +62,92 @@ func (s *smtpMailer) SendEmail(emailAddress, subject string, body []byte) error
 	}
 	return e.Send(addr, auth)
 }
+
+// newEmail builds the message which is sent for the e-mail.
+func newEmail(from string, msg message.Email) *email.Email {
+	e := email.NewEmail()
+	e.From = "cloud.gov <" + from + ">"
+	e.To = []string{" <" + msg.To + ">"}
+	e.Text = msg.Text
+	e.HTML = msg.HTML
+	e.Subject = msg.Subject
+	return e
+}
+
+// previewIndexFile lists the e-mails written by the preview mailer.
+const previewIndexFile = "index.html"
+
+var previewIndexTemplate = template.Must(template.New(previewIndexFile).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>buildpack-notify preview</title></head>
+<body>
+<h1>{{len .}} e-mail(s)</h1>
+<table>
+<tr><th>File</th><th>To</th><th>Subject</th></tr>
+{{- range .}}
+<tr><td><a href="{{.File}}">{{.File}}</a></td><td>{{.To}}</td><td>{{.Subject}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// unsafeFileNameChars are replaced in recipients to make the names of preview files.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9@._-]`)
+
+// InitPreviewMailer creates a new Mailer which writes each e-mail to an .eml file in the directory instead of
+// sending it, along with an index of the e-mails. The e-mails and index of earlier previews are removed first, so
+// the directory only has the e-mails of this run.
+func InitPreviewMailer(dir string, from string) (Mailer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	earlier, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range append(earlier, filepath.Join(dir, previewIndexFile)) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return &previewMailer{dir: dir, from: from}, nil
+}
+
+type previewMailer struct {
+	dir     string
+	from    string
+	entries []previewEntry
+}
+
+type previewEntry struct {
+	File    string
+	To      string
+	Subject string
+}
+
+// SendEmail writes the e-mail as it would be sent, headers and all, and updates the index.
+func (p *previewMailer) SendEmail(msg message.Email) error {
+	raw, err := newEmail(p.from, msg).Bytes()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%04d-%s.eml", len(p.entries)+1, unsafeFileNameChars.ReplaceAllString(msg.To, "_"))
+	if err := os.WriteFile(filepath.Join(p.dir, name), raw, 0644); err != nil {
+		return err
+	}
+	p.entries = append(p.entries, previewEntry{File: name, To: msg.To, Subject: msg.Subject})
+	return p.writeIndex()
+}
+
+func (p *previewMailer) writeIndex() error {
+	f, err := os.Create(filepath.Join(p.dir, previewIndexFile))
+	if err != nil {
+		return err
+	}
+	if err := previewIndexTemplate.Execute(f, p.entries); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloud-gov/buildpack-notify/message"
+	"github.com/jordan-wright/email"
+)
+
+func TestPreviewMailer(t *testing.T) {
+	dir := t.TempDir()
+	// An earlier preview left e-mails which aren't sent in this run.
+	for _, file := range []string{"0003-old@example.com.eml", previewIndexFile, "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte("earlier"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mailer, err := InitPreviewMailer(dir, "no-reply@cloud.gov")
+	if err != nil {
+		t.Fatalf("Unable to create preview mailer. Error: %s", err.Error())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "0003-old@example.com.eml")); !os.IsNotExist(err) {
+		t.Errorf("Expected the e-mails of the earlier preview to be removed. Error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("Expected other files to be kept. Error: %s", err.Error())
+	}
+	emails := []message.Email{
+		{To: user1, Subject: "Action required", Text: []byte("plain body"), HTML: []byte("<p>html body</p>")},
+		{To: "odd/user@example.com", Subject: "Reminder", Text: []byte("reminder body")},
+	}
+	for _, msg := range emails {
+		if err := mailer.SendEmail(msg); err != nil {
+			t.Fatalf("Unable to write e-mail. Error: %s", err.Error())
+		}
+	}
+
+	testCases := []struct {
+		file string
+		msg  message.Email
+	}{
+		{"0001-user1@example.com.eml", emails[0]},
+		{"0002-odd_user@example.com.eml", emails[1]},
+	}
+	index, err := os.ReadFile(filepath.Join(dir, previewIndexFile))
+	if err != nil {
+		t.Fatalf("Unable to read index. Error: %s", err.Error())
+	}
+	for _, tc := range testCases {
+		f, err := os.Open(filepath.Join(dir, tc.file))
+		if err != nil {
+			t.Fatalf("Test %s failed. Unable to open e-mail. Error: %s", tc.file, err.Error())
+		}
+		e, err := email.NewEmailFromReader(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Test %s failed. Unable to parse e-mail. Error: %s", tc.file, err.Error())
+		}
+		if e.Subject != tc.msg.Subject || !strings.Contains(e.To[0], tc.msg.To) || !strings.Contains(e.From, "no-reply@cloud.gov") {
+			t.Errorf("Test %s failed. Unexpected headers %+v", tc.file, e)
+		}
+		if strings.TrimSpace(string(e.Text)) != string(tc.msg.Text) || strings.TrimSpace(string(e.HTML)) != string(tc.msg.HTML) {
+			t.Errorf("Test %s failed. Unexpected bodies %q and %q", tc.file, e.Text, e.HTML)
+		}
+		if !strings.Contains(string(index), `href="`+tc.file+`"`) {
+			t.Errorf("Test %s failed. Expected the e-mail to be in the index %s", tc.file, index)
+		}
+	}
+	if strings.Contains(string(index), "earlier") || strings.Count(string(index), "<a href") != len(emails) {
+		t.Errorf("Expected only the e-mails of this run in the index %s", index)
+	}
+}
+
+func TestPreviewMailerNamesFilesInRecipientOrder(t *testing.T) {
+	app := notifyApp{App: App{GUID: "app1", Name: "testapp"}, Buildpack: buildpackReleaseInfo{BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}}
+	users := map[string][]notifyApp{}
+	for _, user := range []string{"c@example.com", "a@example.com", "d@example.com", "b@example.com"} {
+		users[user] = []notifyApp{app}
+	}
+	templates, _ := initTemplates()
+	for i := 0; i < 3; i++ {
+		dir := t.TempDir()
+		mailer, err := InitPreviewMailer(dir, "no-reply@cloud.gov")
+		if err != nil {
+			t.Fatalf("Unable to create preview mailer. Error: %s", err.Error())
+		}
+		if _, err := sendNotifyEmailToUsers(users, templates, mailer, newSavedState(), false); err != nil {
+			t.Fatalf("Unable to write e-mails. Error: %s", err.Error())
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+		for j, file := range files {
+			files[j] = filepath.Base(file)
+		}
+		expected := []string{"0001-a@example.com.eml", "0002-b@example.com.eml", "0003-c@example.com.eml", "0004-d@example.com.eml"}
+		if !reflect.DeepEqual(files, expected) {
+			t.Errorf("Expected the e-mails to be numbered in recipient order. Actual %v", files)
+		}
+	}
+}
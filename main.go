@@ -2,7 +2,7 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,19 +11,66 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
+	"github.com/cloud-gov/buildpack-notify/message"
 	"github.com/cloudfoundry-community/go-cfclient"
-	"github.com/kelseyhightower/envconfig"
 )
 
-// TODO: handle errors centrally.
-
 type Config struct {
-	InState  string `envconfig:"in_state" required:"true"`
-	OutState string `envconfig:"out_state" required:"true"`
-	DryRun   bool   `envconfig:"dry_run"`
+	StateStore  string `envconfig:"state_store" default:"files"`
+	InState     string `envconfig:"in_state"`
+	OutState    string `envconfig:"out_state"`
+	StateFile   string `envconfig:"state_file"`
+	DatabaseURL string `envconfig:"database_url"`
+	DryRun      bool   `envconfig:"dry_run"`
+	// NotifyRoles are the roles of the users who are notified about outdated apps.
+	NotifyRoles []string `envconfig:"notify_roles" default:"space_manager,space_developer"`
+	// UserOrigins are the origins of the users who get e-mails, e.g. uaa for users with CF passwords or the origin
+	// of an SSO identity provider. Users from any origin get e-mails when it is empty.
+	UserOrigins []string `envconfig:"user_origins"`
+	// ReminderRoles are the roles of the users who are reminded about outdated apps. Defaults to NotifyRoles.
+	ReminderRoles []string `envconfig:"reminder_roles"`
+	// ReminderDays is the number of days after the first e-mail to send each reminder, e.g. 7,14,30.
+	ReminderDays []int `envconfig:"reminder_days"`
+	// EscalationDays is the number of days after the first e-mail to escalate apps which are still outdated
+	// to org managers. Escalation is disabled when it is 0.
+	EscalationDays            int  `envconfig:"escalation_days"`
+	EscalateToBillingManagers bool `envconfig:"escalate_to_billing_managers"`
+	// SlackWebhookURL is a Slack-compatible incoming webhook for chat summaries. Chat summaries are disabled when it is empty.
+	SlackWebhookURL string `envconfig:"slack_webhook_url"`
+	// SlackChannel is where the run summary for platform operators is posted. Defaults to the webhook's channel.
+	SlackChannel  string `envconfig:"slack_channel"`
+	SlackUsername string `envconfig:"slack_username"`
+	SlackIconURL  string `envconfig:"slack_icon_url"`
+	// WebhookURL receives a signed JSON event for each outdated app. Webhooks are disabled when it is empty.
+	WebhookURL         string `envconfig:"webhook_url"`
+	WebhookSecret      string `envconfig:"webhook_secret"`
+	WebhookMaxAttempts int    `envconfig:"webhook_max_attempts" default:"3"`
+	// ReportFile is where the JSON report of the run is written. No report is written when it is empty.
+	ReportFile string `envconfig:"report_file"`
+	// PreviewDir turns on preview mode. E-mails are written to .eml files in it instead of being sent, and
+	// nothing else is changed, as in a dry run.
+	PreviewDir string `envconfig:"preview_dir"`
+	// Schedule is when the serve command runs, e.g. "@every 1h" or a cron expression like "0 * * * *".
+	Schedule string `envconfig:"schedule" default:"@every 1h"`
+	// Port is where the serve command listens for health checks.
+	Port string `envconfig:"port" default:"8080"`
+	// MetricsFile is where the metrics are written after each run for the node exporter's textfile collector.
+	MetricsFile string `envconfig:"metrics_file"`
+	// IncludeOrgs and IncludeSpaces limit the run to the apps in the orgs and spaces which match any of the
+	// patterns. ExcludeOrgs and ExcludeSpaces leave out the apps in the orgs and spaces which match any of them.
+	// A pattern is a name, a GUID or a glob like cf-*. Space patterns can also be org/space, e.g. sandbox-*/dev.
+	IncludeOrgs   []string `envconfig:"include_orgs"`
+	ExcludeOrgs   []string `envconfig:"exclude_orgs"`
+	IncludeSpaces []string `envconfig:"include_spaces"`
+	ExcludeSpaces []string `envconfig:"exclude_spaces"`
+	// Concurrency is the most CF API lookups about apps, spaces and orgs done at a time.
+	Concurrency int `envconfig:"concurrency" default:"8"`
 }
 
 type EmailConfig struct {
@@ -41,14 +88,25 @@ type CFAPIConfig struct {
 	ClientSecret string `envconfig:"client_secret" required:"true"`
 }
 
-type buildpackRecord struct {
-	LastUpdatedAt string
+type buildpackReleaseInfo struct {
+	BuildpackName      string
+	BuildpackVersion   string
+	BuildpackURL       string
+	BuildpackGUID      string
+	BuildpackUpdatedAt string
 }
 
-type buildpackReleaseInfo struct {
-	BuildpackName    string
-	BuildpackVersion string
-	BuildpackURL     string
+// notifyApp pairs an app with the release of the buildpack that made it outdated.
+// This is what owners are told about in the notify e-mail.
+type notifyApp struct {
+	App
+	Buildpack buildpackReleaseInfo
+	// OutdatedBuildpacks are all the buildpacks of the app's droplet which are outdated, including Buildpack.
+	OutdatedBuildpacks []buildpackReleaseInfo
+	DropletCreatedAt   string
+	DropletAgeDays     int
+	// SnoozedUntil is the date until which no reminders are sent about the app, if they are snoozed.
+	SnoozedUntil string
 }
 
 func getBuildpackReleaseURL(buildpackName string) string {
@@ -111,122 +169,228 @@ func getBuildpackVersionURL(buildpackReleaseURL string, buildpackVersion string)
 	return buildpackVersionURL
 }
 
-func loadState(path string) (map[string]buildpackRecord, error) {
-	fp, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer fp.Close()
-	decoder := json.NewDecoder(fp)
-	var state map[string]buildpackRecord
-	if err := decoder.Decode(&state); err != nil {
-		return nil, err
-	}
-	return state, nil
+func main() {
+	os.Exit(runCommand(os.Args[1:], os.Stdout))
 }
 
-func copyState(inPath, outPath string) error {
-	in, err := os.Open(inPath)
-	if err != nil {
+// validateConfig checks the parts of the config which envconfig can't.
+func validateConfig(config Config) error {
+	if err := validateRecipientRoles(config.NotifyRoles); err != nil {
 		return err
 	}
-	defer in.Close()
-	out, err := os.Create(outPath)
-	if err != nil {
+	if err := validateRecipientRoles(config.ReminderRoles); err != nil {
 		return err
 	}
-	defer out.Close()
-	_, err = io.Copy(out, in)
-	return err
+	if config.Concurrency < 1 {
+		return fmt.Errorf("CONCURRENCY must be at least 1")
+	}
+	if config.WebhookURL != "" && config.WebhookSecret == "" {
+		return fmt.Errorf("WEBHOOK_SECRET is required when WEBHOOK_URL is set")
+	}
+	return newScope(config).validate()
 }
 
-func saveState(state map[string]buildpackRecord, path string) error {
-	fp, err := os.Create(path)
-	if err != nil {
-		return err
+// run checks for outdated apps and tells their owners. Errors which stop the run are returned and leave the state
+// as it was. Errors about single apps or recipients are collected in the result, and the state is still saved.
+// The result is returned even when the run stops so that it can be reported.
+func run(config Config, emailConfig EmailConfig, cfAPIConfig CFAPIConfig) (*runResult, error) {
+	// A preview sends the e-mails to files and changes nothing else.
+	dryRun := config.DryRun || config.PreviewDir != ""
+	emailDryRun := config.DryRun && config.PreviewDir == ""
+	result := &runResult{Report: newRunReport(dryRun)}
+	if config.PreviewDir != "" {
+		log.Printf("Preview mode activated. E-mails are written to %s and no modifications happening\n", config.PreviewDir)
+	} else if config.DryRun {
+		log.Println("Dry-Run mode activated. No modifications happening")
 	}
-	defer fp.Close()
-	encoder := json.NewEncoder(fp)
-	return encoder.Encode(state)
-}
 
-func main() {
-	var (
-		config      Config
-		emailConfig EmailConfig
-		cfAPIConfig CFAPIConfig
-	)
+	store, err := newStateStore(config)
+	if err != nil {
+		return result, fmt.Errorf("unable to create state store: %s", err)
+	}
+	defer store.Close()
+	state, err := store.Load()
+	if err != nil {
+		return result, fmt.Errorf("error reading state: %s", err)
+	}
+	previousBuildpacks := copyBuildpackRecords(state.Buildpacks)
 
-	if err := envconfig.Process("", &config); err != nil {
-		log.Fatalf("Unable to parse config: %s", err.Error())
+	templates, err := initTemplates()
+	if err != nil {
+		return result, fmt.Errorf("unable to initialize templates: %s", err)
+	}
+	client, err := newCFClient(cfAPIConfig)
+	if err != nil {
+		return result, fmt.Errorf("unable to create client: %s", err)
+	}
+	log.Println("Calculating notifications to send for outdated buildpacks.")
+	mailer := InitSMTPMailer(emailConfig)
+	if config.PreviewDir != "" {
+		if mailer, err = InitPreviewMailer(config.PreviewDir, emailConfig.From); err != nil {
+			return result, fmt.Errorf("unable to create preview directory: %s", err)
+		}
+	}
+	apps, buildpacks, err := getAppsAndBuildpacks(client, state, config, result)
+	if err != nil {
+		return result, err
 	}
-	if err := envconfig.Process("", &emailConfig); err != nil {
-		log.Fatalf("Unable to parse email config: %s", err.Error())
+	outdatedApps, err := findOutdatedApps(client, apps, buildpacks, result.Report, config.Concurrency)
+	result.addDiscoveryError(err)
+	applySnoozes(outdatedApps, state, time.Now())
+	result.Report.addSnoozes(outdatedApps)
+	owners, err := findOwnersOfApps(outdatedApps, config.NotifyRoles, config.UserOrigins, client, config.Concurrency)
+	result.addDiscoveryError(err)
+	log.Printf("Will notify %d owners of outdated apps.\n", len(owners))
+	// Remember which releases were handled by earlier runs before recording this run's notifications.
+	newlyOutdatedApps := filterForNewlyOutdatedApps(outdatedApps, state.notifiedReleases())
+	summary := runSummary{
+		OutdatedApps:      len(groupAppsByGUID(outdatedApps)),
+		NewlyOutdatedApps: len(groupAppsByGUID(newlyOutdatedApps)),
+		Spaces:            countSpacesOfApps(outdatedApps),
+		Buildpacks:        getBuildpacksOfApps(newlyOutdatedApps),
+	}
+	if emailDryRun {
+		result.Report.addDryRunNotifications(owners, state)
+	}
+	summary.NotificationsSent, err = sendNotifyEmailToUsers(owners, templates, mailer, state, emailDryRun)
+	result.addError(err)
+	if config.WebhookURL != "" {
+		if dryRun {
+			result.Report.addDryRunWebhookEvents(outdatedApps, config.WebhookURL, state)
+		}
+		_, err = sendWebhookEvents(outdatedApps, InitWebhookSender(config), state, dryRun)
+		result.addError(err)
 	}
-	if err := envconfig.Process("", &cfAPIConfig); err != nil {
-		log.Fatalf("Unable to parse cf api config: %s", err.Error())
+	if len(config.ReminderDays) > 0 {
+		reminderOwners := owners
+		if len(config.ReminderRoles) > 0 {
+			reminderOwners, err = findOwnersOfApps(outdatedApps, config.ReminderRoles, config.UserOrigins, client, config.Concurrency)
+			// Reminders are worked out from the notification history, so missed ones are sent on the next run.
+			result.addError(err)
+		}
+		if emailDryRun {
+			result.Report.addDryRunReminders(reminderOwners, state, config.ReminderDays)
+		}
+		summary.RemindersSent, err = sendReminderEmailToUsers(reminderOwners, templates, mailer, state, config.ReminderDays, emailDryRun)
+		result.addError(err)
+	}
+	laggingApps := filterForLaggingApps(outdatedApps, state, config.EscalationDays, time.Now())
+	if len(laggingApps) > 0 {
+		managers, err := findOrgManagersOfApps(laggingApps, getEscalationRoles(config.EscalateToBillingManagers), config.UserOrigins, client, config.Concurrency)
+		result.addError(err)
+		log.Printf("Will escalate %d lagging apps to %d org managers.\n", len(laggingApps), len(managers))
+		if emailDryRun {
+			result.Report.addDryRunEscalations(managers, state)
+		}
+		summary.EscalationsSent, err = sendEscalationEmailToUsers(managers, templates, mailer, state, config.EscalationDays, emailDryRun)
+		result.addError(err)
+	}
+	if config.SlackWebhookURL != "" {
+		notifier := InitSlackNotifier(config)
+		spaceSummaries := findSpaceSummaries(newlyOutdatedApps)
+		result.addError(sendSpaceSummaries(spaceSummaries, notifier, dryRun))
+		if !dryRun {
+			if err := notifier.NotifyRun(summary); err != nil {
+				result.addError(fmt.Errorf("unable to post run summary: %s", err))
+			}
+		}
 	}
 
-	if config.DryRun {
-		log.Println("Dry-Run mode activated. No modifications happening")
+	result.Report.addDeliveries(deliveryNotification, state.Notifications)
+	result.Report.addDeliveries(deliveryReminder, state.reminderAttempts())
+	result.Report.addDeliveries(deliveryEscalation, state.Escalations)
+	result.Report.addDeliveries(deliveryWebhook, state.Webhooks)
+
+	if dryRun {
+		if err := store.Preserve(); err != nil {
+			return result, fmt.Errorf("error preserving state: %s", err)
+		}
+		return result, nil
 	}
+	result.prepareStateForCommit(state, previousBuildpacks)
+	if err := store.Save(state); err != nil {
+		return result, fmt.Errorf("error saving state: %s", err)
+	}
+	return result, nil
+}
 
-	state, err := loadState(config.InState)
+// check lists the apps using an outdated buildpack, whether or not their owners were told about them. Nothing is
+// sent and the state isn't used.
+func check(config Config, cfAPIConfig CFAPIConfig, w io.Writer) (*runResult, error) {
+	result := &runResult{Report: newRunReport(true)}
+	client, err := newCFClient(cfAPIConfig)
 	if err != nil {
-		log.Fatalf("Error reading state: %s", err)
+		return result, fmt.Errorf("unable to create client: %s", err)
 	}
-
-	templates, err := initTemplates()
+	apps, err := listAppsInScope(client, newScope(config))
 	if err != nil {
-		log.Fatalf("Unable to initialize templates: %s", err)
+		return result, fmt.Errorf("unable to get apps: %s", err)
+	}
+	buildpackList, err := ListBuildpacks(client)
+	if err != nil {
+		return result, fmt.Errorf("unable to get buildpacks: %s", err)
+	}
+	buildpacks := make(map[string]Buildpack)
+	for _, buildpack := range buildpackList {
+		buildpacks[buildpack.Name] = buildpack
 	}
-	client, err := cfclient.NewClient(&cfclient.Config{
+	outdatedApps, err := findOutdatedApps(client, apps, buildpacks, result.Report, config.Concurrency)
+	result.addError(err)
+	if err := printOutdatedApps(w, outdatedApps, time.Now()); err != nil {
+		return result, fmt.Errorf("unable to print outdated apps: %s", err)
+	}
+	return result, nil
+}
+
+// printOutdatedApps prints a table of the outdated apps.
+func printOutdatedApps(w io.Writer, apps []notifyApp, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORG\tSPACE\tAPP\tBUILDPACK\tVERSION\tDROPLET AGE (DAYS)")
+	for _, app := range apps {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", app.Org.Name, app.Space.Name,
+			app.Name, app.Buildpack.BuildpackName, app.Buildpack.BuildpackVersion, dropletAgeDays(app.DropletCreatedAt, now))
+	}
+	return tw.Flush()
+}
+
+// newCFClient creates a client for the CF API.
+func newCFClient(cfAPIConfig CFAPIConfig) (*cfclient.Client, error) {
+	return cfclient.NewClient(&cfclient.Config{
 		ApiAddress:        cfAPIConfig.API,
 		ClientID:          cfAPIConfig.ClientID,
 		ClientSecret:      cfAPIConfig.ClientSecret,
 		SkipSslValidation: os.Getenv("INSECURE") == "1",
-		HttpClient:        &http.Client{Timeout: 30 * time.Second},
+		HttpClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &rateLimitTransport{base: newMetricsTransport(appMetrics, os.Getenv("INSECURE") == "1")},
+		},
 	})
-	if err != nil {
-		log.Fatalf("Unable to create client. Error: %s", err.Error())
-	}
-	log.Println("Calculating notifications to send for outdated buildpacks.")
-	mailer := InitSMTPMailer(emailConfig)
-	apps, buildpacks, state := getAppsAndBuildpacks(client, state)
-	outdatedApps, updatedBuildpacks := findOutdatedApps(client, apps, buildpacks)
-	outdatedV2Apps := convertToV2Apps(client, outdatedApps)
-	owners := findOwnersOfApps(outdatedV2Apps, client)
-	log.Printf("Will notify %d owners of outdated apps.\n", len(owners))
-	updatedBuildpacks = deduplicateBuildpacks(updatedBuildpacks)
-	sendNotifyEmailToUsers(owners, updatedBuildpacks, templates, mailer, config.DryRun)
+}
 
-	if config.DryRun {
-		if err := copyState(config.InState, config.OutState); err != nil {
-			log.Fatalf("Error copying state: %s", err)
-		}
-	} else {
-		if err := saveState(state, config.OutState); err != nil {
-			log.Fatalf("Error saving state: %s", err)
-		}
+// copyBuildpackRecords copies the buildpack records so they can be restored if the run is incomplete.
+func copyBuildpackRecords(records map[string]buildpackRecord) map[string]buildpackRecord {
+	copied := make(map[string]buildpackRecord, len(records))
+	for guid, record := range records {
+		copied[guid] = record
 	}
+	return copied
 }
 
-// convertToV2Apps will take a V3 App object and convert it to a V2 App object.
-// This is useful because the V2 App object has more space information at the moment.
-func convertToV2Apps(client *cfclient.Client, apps []App) []cfclient.App {
-	v2Apps := []cfclient.App{}
-	for _, app := range apps {
-		v2App, err := client.GetAppByGuid(app.GUID)
-		if err != nil {
-			log.Fatalf("Unable to convert v3 app to v2 app. App Guid %s", app.GUID)
-		}
-		v2Apps = append(v2Apps, v2App)
+// dropletAgeDays gets the number of whole days since the droplet was created, or 0 if the time can't be parsed.
+func dropletAgeDays(dropletCreatedAt string, now time.Time) int {
+	createdAt, err := time.Parse(time.RFC3339, dropletCreatedAt)
+	if err != nil {
+		return 0
 	}
-	return v2Apps
+	return int(now.Sub(createdAt).Hours() / 24)
 }
 
-func filterForNewlyUpdatedBuildpacks(buildpacks []cfclient.Buildpack, state map[string]buildpackRecord) ([]cfclient.Buildpack, map[string]buildpackRecord) {
-	filteredBuildpacks := []cfclient.Buildpack{}
+// filterForNewlyUpdatedBuildpacks gets the buildpacks which were updated since they were recorded in the state
+// and records them. Buildpacks with an update time which can't be parsed are left out with an error. A stored
+// time which can't be parsed is replaced, so the buildpack counts as updated.
+func filterForNewlyUpdatedBuildpacks(buildpacks []Buildpack, state map[string]buildpackRecord) ([]Buildpack, map[string]buildpackRecord, error) {
+	filteredBuildpacks := []Buildpack{}
+	var errs []error
 	// Go through the passed in buildpacks
 	// Check if current buildpack.guid matches a guid in storeBuildpacks
 	// 1) If so, compare the buildpack.Meta.UpdatedAt with the storeBuildpack.LastUpdatedAt
@@ -237,24 +401,25 @@ func filterForNewlyUpdatedBuildpacks(buildpacks []cfclient.Buildpack, state map[
 	// for buildpacks return buildpack.guid in stored.
 
 	for _, buildpack := range buildpacks {
-		storedBuildpack, found := state[buildpack.Guid]
+		storedBuildpack, found := state[buildpack.GUID]
 		if !found {
 			filteredBuildpacks = append(filteredBuildpacks, buildpack)
-			state[buildpack.Guid] = buildpackRecord{LastUpdatedAt: buildpack.UpdatedAt}
+			state[buildpack.GUID] = buildpackRecord{LastUpdatedAt: buildpack.UpdatedAt}
 		} else {
 			buildpackUpdatedAt, err := time.Parse(time.RFC3339, buildpack.UpdatedAt)
 			if err != nil {
-				log.Fatalf("Unable to parse buildpack updatedAt time. Buildpack GUID %s Error %s",
-					buildpack.Guid, err)
+				errs = append(errs, fmt.Errorf("unable to parse buildpack updatedAt time. Buildpack GUID %s: %s",
+					buildpack.GUID, err))
+				continue
 			}
 			storedBuildpackUpdatedAt, err := time.Parse(time.RFC3339, storedBuildpack.LastUpdatedAt)
 			if err != nil {
-				log.Fatalf("Unable to parse stored buildpack LastUpdatedAt time. Buildpack GUID %s Error %s",
-					buildpack.Guid, err)
+				log.Printf("Unable to parse stored buildpack LastUpdatedAt time. Buildpack GUID %s Error %s\n",
+					buildpack.GUID, err)
 			}
-			if buildpackUpdatedAt.After(storedBuildpackUpdatedAt) {
+			if err != nil || buildpackUpdatedAt.After(storedBuildpackUpdatedAt) {
 				filteredBuildpacks = append(filteredBuildpacks, buildpack)
-				state[buildpack.Guid] = buildpackRecord{LastUpdatedAt: buildpack.UpdatedAt}
+				state[buildpack.GUID] = buildpackRecord{LastUpdatedAt: buildpack.UpdatedAt}
 			} else {
 				log.Printf("Supported Buildpack %s has not been updated\n", buildpack.Name)
 				continue
@@ -263,27 +428,60 @@ func filterForNewlyUpdatedBuildpacks(buildpacks []cfclient.Buildpack, state map[
 
 	}
 
-	return filteredBuildpacks, state
+	return filteredBuildpacks, state, errors.Join(errs...)
 }
 
-func getAppsAndBuildpacks(client *cfclient.Client, state map[string]buildpackRecord) ([]App, map[string]cfclient.Buildpack, map[string]buildpackRecord) {
-	apps, err := ListApps(client)
+// getAppsAndBuildpacks gets all the apps and the buildpacks to check them against: the buildpacks
+// which have been updated since the last run and those with notifications that still need to be retried
+// or reminders or escalations that are due. Not being able to list the apps or buildpacks stops the run.
+func getAppsAndBuildpacks(client *cfclient.Client, state *savedState, config Config, result *runResult) ([]App, map[string]Buildpack, error) {
+	appScope := newScope(config)
+	apps, err := listAppsInScope(client, appScope)
 	if err != nil {
-		log.Fatalf("Unable to get apps. Error: %s", err.Error())
+		return nil, nil, fmt.Errorf("unable to get apps: %s", err)
 	}
 	// Get all the buildpacks from our CF deployment via CF_API.
-	buildpackList, err := client.ListBuildpacks()
+	buildpackList, err := ListBuildpacks(client)
 	if err != nil {
-		log.Fatalf("Unable to get buildpacks. Error: %s", err)
+		return nil, nil, fmt.Errorf("unable to get buildpacks: %s", err)
+	}
+	state.pruneNotifications(buildpackList)
+	filteredBuildpackList, buildpackRecords, err := filterForNewlyUpdatedBuildpacks(buildpackList, copyBuildpackRecords(state.Buildpacks))
+	result.addDiscoveryError(err)
+	// Only a run over the whole foundation marks buildpack updates as handled, so the apps left out
+	// of a scoped run are still checked against them once the scope is widened.
+	if appScope.isEmpty() {
+		state.Buildpacks = buildpackRecords
+	} else {
+		log.Println("Run is limited to some orgs and spaces. Buildpack updates are not recorded as handled")
 	}
-	filteredBuildpackList, state := filterForNewlyUpdatedBuildpacks(buildpackList, state)
 
 	// Create a map with the key being the buildpack name for quick comparison later on.
-	buildpacks := make(map[string]cfclient.Buildpack)
+	buildpacks := make(map[string]Buildpack)
 	for _, buildpack := range filteredBuildpackList {
 		buildpacks[buildpack.Name] = buildpack
 	}
-	return apps, buildpacks, state
+	now := time.Now()
+	firstNotified := state.firstNotifiedTimes()
+	remindersSent := state.remindersSentCounts()
+	escalatedApps := state.escalatedApps()
+	pendingEscalations := state.pendingEscalations()
+	for _, buildpack := range buildpackList {
+		if _, found := buildpacks[buildpack.Name]; found {
+			continue
+		}
+		if state.hasPendingNotifications(buildpack.GUID, buildpack.UpdatedAt) {
+			log.Printf("Supported Buildpack %s has notifications to retry\n", buildpack.Name)
+			buildpacks[buildpack.Name] = buildpack
+		} else if state.hasDueReminders(buildpack.GUID, buildpack.UpdatedAt, config.ReminderDays, now, firstNotified, remindersSent) {
+			log.Printf("Supported Buildpack %s has reminders due\n", buildpack.Name)
+			buildpacks[buildpack.Name] = buildpack
+		} else if state.hasDueEscalations(buildpack.GUID, buildpack.UpdatedAt, config.EscalationDays, now, firstNotified, escalatedApps, pendingEscalations) {
+			log.Printf("Supported Buildpack %s has escalations due\n", buildpack.Name)
+			buildpacks[buildpack.Name] = buildpack
+		}
+	}
+	return apps, buildpacks, nil
 }
 
 func deduplicateBuildpacks(allBuildpacks []buildpackReleaseInfo) []buildpackReleaseInfo {
@@ -298,172 +496,552 @@ func deduplicateBuildpacks(allBuildpacks []buildpackReleaseInfo) []buildpackRele
 	return deduplicated
 }
 
-// isDropletUsingSupportedBuildpack checks the buildpacks the droplet is using and comparing to see if one of them
-// is a provided system buildpack.
-func isDropletUsingSupportedBuildpack(droplet Droplet, buildpacks map[string]cfclient.Buildpack) (bool, *cfclient.Buildpack) {
+// getSupportedBuildpacksOfDroplet gets the provided system buildpacks the droplet is using, in the order they ran.
+// Droplets staged with several buildpacks, e.g. nodejs_buildpack and python_buildpack, can use more than one.
+func getSupportedBuildpacksOfDroplet(droplet Droplet, buildpacks map[string]Buildpack) []Buildpack {
+	var supported []Buildpack
+	seen := make(map[string]bool)
 	for _, dropletBuildpack := range droplet.Buildpacks {
-		if buildpack, found := buildpacks[dropletBuildpack.Name]; found && dropletBuildpack.Name != "" {
-			return true, &buildpack
+		if buildpack, found := buildpacks[dropletBuildpack.Name]; found && dropletBuildpack.Name != "" && !seen[dropletBuildpack.Name] {
+			seen[dropletBuildpack.Name] = true
+			supported = append(supported, buildpack)
 		}
 	}
-	return false, nil
+	return supported
 }
 
 // isDropletUsingOutdatedBuildpack checks if the droplet was created before the last time the buildpack was updated.
 // This comparison is the heart of checking whether the app needs an update.
 // Format of time stamp: 2016-06-08T16:41:45Z
-func isDropletUsingOutdatedBuildpack(client *cfclient.Client, droplet Droplet, buildpack *cfclient.Buildpack) bool {
+func isDropletUsingOutdatedBuildpack(droplet Droplet, buildpack *Buildpack) (bool, error) {
 	timeOfLastAppRestage, err := time.Parse(time.RFC3339, droplet.CreatedAt)
 	if err != nil {
-		log.Fatalf("Unable to parse last restage time. Droplet GUID %s Error %s",
-			droplet.GUID, err)
+		return false, fmt.Errorf("unable to parse last restage time. Droplet GUID %s: %s", droplet.GUID, err)
 	}
 	timeOfLastBuildpackUpdate, err := time.Parse(time.RFC3339, buildpack.UpdatedAt)
 	if err != nil {
-		log.Fatalf("Unable to parse last buildpack update time. Buildpack %s Buildpack GUID %s Error %s",
-			buildpack.Name, buildpack.Guid, err)
+		return false, fmt.Errorf("unable to parse last buildpack update time. Buildpack %s Buildpack GUID %s: %s",
+			buildpack.Name, buildpack.GUID, err)
 	}
-	return timeOfLastBuildpackUpdate.After(timeOfLastAppRestage)
+	return timeOfLastBuildpackUpdate.After(timeOfLastAppRestage), nil
+}
+
+// spaceUser is a user with roles in a space.
+type spaceUser struct {
+	GUID     string
+	Username string
+	Origin   string
+	Roles    []string
 }
 
+// cfSpaceCache is safe for concurrent use. Concurrent lookups of the same org may both go to the API.
 type cfSpaceCache struct {
-	spaceUsers map[string]map[string]cfclient.SpaceRole
+	mu sync.Mutex
+	// spaceUsers is keyed by space GUID and has the users with valid e-mail addresses.
+	spaceUsers map[string][]spaceUser
+	// orgUsers is keyed by org GUID and role.
+	orgUsers map[string][]User
+	// origins are the user origins, e.g. uaa, whose users get e-mails. Users from any origin do when it is empty.
+	origins map[string]bool
 }
 
-func createCFSpaceCache() *cfSpaceCache {
-	return &cfSpaceCache{
-		spaceUsers: make(map[string]map[string]cfclient.SpaceRole),
+func createCFSpaceCache(origins []string) *cfSpaceCache {
+	c := &cfSpaceCache{
+		spaceUsers: make(map[string][]spaceUser),
+		orgUsers:   make(map[string][]User),
+		origins:    make(map[string]bool),
+	}
+	for _, origin := range origins {
+		c.origins[origin] = true
 	}
+	return c
 }
 
-func filterForValidEmailUsernames(users []cfclient.SpaceRole, app cfclient.App) []cfclient.SpaceRole {
-	var filteredUsers []cfclient.SpaceRole
+// allowsOrigin checks whether users from the origin get e-mails.
+func (c *cfSpaceCache) allowsOrigin(origin string) bool {
+	return len(c.origins) == 0 || c.origins[origin]
+}
+
+func filterForValidEmailUsernames(users []spaceUser, spaceGUID string) []spaceUser {
+	var filteredUsers []spaceUser
 	for _, user := range users {
 		if _, err := mail.ParseAddress(user.Username); err == nil {
 			filteredUsers = append(filteredUsers, user)
 		} else {
-			log.Printf("Dropping notification to user %s about app %s in space %s because "+
-				"invalid e-mail address\n", user.Username, app.Name, app.SpaceGuid)
+			log.Printf("Dropping notification to user %s in space %s because "+
+				"invalid e-mail address\n", user.Username, spaceGUID)
 		}
 	}
 	return filteredUsers
 }
 
-func (c *cfSpaceCache) getOwnersInAppSpace(app cfclient.App, client *cfclient.Client) map[string]cfclient.SpaceRole {
-	var ok bool
-	var ownersWithSpaceRoles map[string]cfclient.SpaceRole
-	if ownersWithSpaceRoles, ok = c.spaceUsers[app.SpaceGuid]; ok {
-		return ownersWithSpaceRoles
+// loadSpaceUsers gets the users with any of the roles in the spaces. The roles of a batch of spaces and their users
+// are got together, so there are only a few requests however many spaces there are. It returns an error for each
+// space whose users couldn't be got.
+func (c *cfSpaceCache) loadSpaceUsers(spaceGUIDs []string, roles map[string]bool, client *cfclient.Client, concurrency int) map[string]error {
+	var types []string
+	for role := range roles {
+		types = append(types, role)
 	}
-	space, err := app.Space()
-	if err != nil {
-		log.Fatalf("Unable to get space of app %s. Error: %s", app.Name, err.Error())
+	sort.Strings(types)
+	batches := batchGUIDs(spaceGUIDs)
+	spaceErrs := make(map[string]error)
+	batchErrs := make([]error, len(batches))
+	forEachConcurrently(len(batches), concurrency, func(i int) {
+		batchErrs[i] = c.loadSpaceUsersBatch(batches[i], types, client)
+	})
+	for i, batch := range batches {
+		if batchErrs[i] == nil {
+			continue
+		}
+		for _, spaceGUID := range batch {
+			spaceErrs[spaceGUID] = batchErrs[i]
+		}
 	}
-	spaceRoles, err := space.Roles()
+	return spaceErrs
+}
+
+func (c *cfSpaceCache) loadSpaceUsersBatch(spaceGUIDs []string, types []string, client *cfclient.Client) error {
+	roles, users, err := ListRolesByQuery(client, url.Values{
+		"space_guids": []string{strings.Join(spaceGUIDs, ",")},
+		"types":       []string{strings.Join(types, ",")},
+	})
 	if err != nil {
-		log.Fatalf("Unable to get roles for all users in space %s. Error: %s", space.Name, err.Error())
+		return fmt.Errorf("unable to get roles for all users in spaces: %s", err)
 	}
-	spaceRoles = filterForValidEmailUsernames(spaceRoles, app)
-	ownersWithSpaceRoles = filterForUsersWithRoles(spaceRoles, getAppOwnerRoles())
-
-	c.spaceUsers[app.SpaceGuid] = ownersWithSpaceRoles
+	// Each user has a role resource for each of their roles in a space.
+	spaceUsers := make(map[string]map[string]*spaceUser)
+	for _, spaceGUID := range spaceGUIDs {
+		spaceUsers[spaceGUID] = make(map[string]*spaceUser)
+	}
+	for _, role := range roles {
+		user, found := users[role.Relationships.User.Data.GUID]
+		if !found || !c.allowsOrigin(user.Origin) {
+			continue
+		}
+		usersInSpace, found := spaceUsers[role.Relationships.Space.Data.GUID]
+		if !found {
+			continue
+		}
+		if usersInSpace[user.GUID] == nil {
+			usersInSpace[user.GUID] = &spaceUser{GUID: user.GUID, Username: user.Username, Origin: user.Origin}
+		}
+		usersInSpace[user.GUID].Roles = append(usersInSpace[user.GUID].Roles, role.Type)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for spaceGUID, usersInSpace := range spaceUsers {
+		var spaceUserList []spaceUser
+		for _, user := range usersInSpace {
+			spaceUserList = append(spaceUserList, *user)
+		}
+		sort.Slice(spaceUserList, func(i, j int) bool { return spaceUserList[i].Username < spaceUserList[j].Username })
+		c.spaceUsers[spaceGUID] = filterForValidEmailUsernames(spaceUserList, spaceGUID)
+	}
+	return nil
+}
 
-	return ownersWithSpaceRoles
+// getOwnersInAppSpace gets the users with any of the roles in the app's space, once loadSpaceUsers has got them.
+func (c *cfSpaceCache) getOwnersInAppSpace(app App, roles map[string]bool) map[string]spaceUser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return filterForUsersWithRoles(c.spaceUsers[app.Space.GUID], roles)
 }
 
-// Returns a map of space roles we consider to be an owner.
-// We return a map for quick look-ups and comparisons.
-func getAppOwnerRoles() map[string]bool {
+const (
+	spaceManagerRole      = "space_manager"
+	spaceDeveloperRole    = "space_developer"
+	spaceAuditorRole      = "space_auditor"
+	spaceSupporterRole    = "space_supporter"
+	orgManagerRole        = "org_manager"
+	orgAuditorRole        = "org_auditor"
+	orgBillingManagerRole = "org_billing_manager"
+)
+
+// Returns a map of the roles users can have to receive e-mails about apps and whether they are space roles.
+// Space roles are looked up in the app's space and org roles in the app's org.
+func getRecipientRoles() map[string]bool {
 	return map[string]bool{
-		"space_manager":   true,
-		"space_developer": true,
+		spaceManagerRole:      true,
+		spaceDeveloperRole:    true,
+		spaceAuditorRole:      true,
+		spaceSupporterRole:    true,
+		orgManagerRole:        false,
+		orgAuditorRole:        false,
+		orgBillingManagerRole: false,
+	}
+}
+
+// validateRecipientRoles checks that users can receive e-mails for all of the roles.
+func validateRecipientRoles(roles []string) error {
+	recipientRoles := getRecipientRoles()
+	for _, role := range roles {
+		if _, found := recipientRoles[role]; !found {
+			return fmt.Errorf("unknown recipient role %s", role)
+		}
 	}
+	return nil
 }
 
-func filterForUsersWithRoles(spaceUsers []cfclient.SpaceRole, filteredRoles map[string]bool) map[string]cfclient.SpaceRole {
-	filteredSpaceUsers := make(map[string]cfclient.SpaceRole)
+// splitRecipientRoles splits the roles into a map of space roles, for quick look-ups and comparisons,
+// and a list of org roles.
+func splitRecipientRoles(roles []string) (map[string]bool, []string) {
+	recipientRoles := getRecipientRoles()
+	spaceRoles := make(map[string]bool)
+	var orgRoles []string
+	for _, role := range roles {
+		if recipientRoles[role] {
+			spaceRoles[role] = true
+		} else {
+			orgRoles = append(orgRoles, role)
+		}
+	}
+	return spaceRoles, orgRoles
+}
+
+func filterForUsersWithRoles(spaceUsers []spaceUser, filteredRoles map[string]bool) map[string]spaceUser {
+	filteredSpaceUsers := make(map[string]spaceUser)
 	for _, spaceUser := range spaceUsers {
 		if spaceUserHasRoles(spaceUser, filteredRoles) {
-			filteredSpaceUsers[spaceUser.Guid] = spaceUser
+			filteredSpaceUsers[spaceUser.GUID] = spaceUser
 		}
 	}
 	return filteredSpaceUsers
 }
 
-func findOwnersOfApps(apps []cfclient.App, client *cfclient.Client) map[string][]cfclient.App {
+// findOwnersOfApps maps the users from the origins with any of the roles in each app's space or org to the apps.
+// Users from any origin are included when origins is empty. Apps with contacts are mapped to them instead.
+// Apps whose owners can't be found are left out and an error is returned for each of them.
+func findOwnersOfApps(apps []notifyApp, roles []string, origins []string, client *cfclient.Client, concurrency int) (map[string][]notifyApp, error) {
 	// Mapping of users to the apps.
-	owners := make(map[string][]cfclient.App)
-	spaceCache := createCFSpaceCache()
+	owners := make(map[string][]notifyApp)
+	var errs []error
+	spaceRoles, orgRoles := splitRecipientRoles(roles)
+	spaceCache := createCFSpaceCache(origins)
+	appContacts := make([][]string, len(apps))
+	var appsWithoutContacts []notifyApp
+	for i, app := range apps {
+		if appContacts[i] = getContacts(app.App); len(appContacts[i]) == 0 {
+			appsWithoutContacts = append(appsWithoutContacts, app)
+		}
+	}
+	var spaceErrs, orgErrs map[string]error
+	if len(spaceRoles) > 0 {
+		spaceErrs = spaceCache.loadSpaceUsers(getSpaceGUIDsOfApps(appsWithoutContacts), spaceRoles, client, concurrency)
+	}
+	if len(orgRoles) > 0 {
+		orgErrs = spaceCache.loadOrgUsers(getOrgGUIDsOfApps(appsWithoutContacts), orgRoles, client, concurrency)
+	}
+	// The roles are all loaded, so the apps are added in order and each user's apps are in the same order on every run.
+	for i, app := range apps {
+		usernames := make(map[string]bool)
+		for _, contact := range appContacts[i] {
+			usernames[contact] = true
+		}
+		if len(appContacts[i]) == 0 {
+			// Get the space
+			if len(spaceRoles) > 0 {
+				if err := spaceErrs[app.Space.GUID]; err != nil {
+					errs = append(errs, &appError{app.GUID, app.Name, "find owners of", err})
+					continue
+				}
+				for _, ownerWithSpaceRoles := range spaceCache.getOwnersInAppSpace(app.App, spaceRoles) {
+					usernames[ownerWithSpaceRoles.Username] = true
+				}
+			}
+			// Get the org
+			if err := orgErrs[app.Org.GUID]; err != nil {
+				errs = append(errs, &appError{app.GUID, app.Name, "find owners of", err})
+				continue
+			}
+			for _, username := range spaceCache.getUsernamesWithOrgRoles(app, orgRoles) {
+				usernames[username] = true
+			}
+		}
+		for username := range usernames {
+			owners[username] = append(owners[username], app)
+		}
+	}
+	return owners, errors.Join(errs...)
+}
+
+// getSpaceGUIDsOfApps gets the sorted GUIDs of the spaces the apps are in.
+func getSpaceGUIDsOfApps(apps []notifyApp) []string {
+	var spaceGUIDs []string
+	seen := make(map[string]bool)
 	for _, app := range apps {
-		// Get the space
-		ownersWithSpaceRoles := spaceCache.getOwnersInAppSpace(app, client)
-		for _, ownerWithSpaceRoles := range ownersWithSpaceRoles {
-			owners[ownerWithSpaceRoles.Username] = append(owners[ownerWithSpaceRoles.Username], app)
+		if !seen[app.Space.GUID] {
+			seen[app.Space.GUID] = true
+			spaceGUIDs = append(spaceGUIDs, app.Space.GUID)
 		}
 	}
-	return owners
+	sort.Strings(spaceGUIDs)
+	return spaceGUIDs
+}
+
+// dropletLookup is the result of getting the current droplet of an app.
+type dropletLookup struct {
+	droplet Droplet
+	found   bool
+	err     error
 }
 
 // getCurrentDropletForApp will try to query the current droplet.
 // A running app will have 1 droplet associated with it.
 // If it doesn't have 1, it's not running. There should be no case when it's more
 // than 1 but if so, we need to do further investigation to handle it.
-func getCurrentDropletForApp(app App, client *cfclient.Client) (Droplet, bool) {
+func getCurrentDropletForApp(app App, client *cfclient.Client) (Droplet, bool, error) {
 	droplets, err := app.GetDropletsByQuery(client, url.Values{"current": []string{"true"}})
 	if err != nil {
-		// Log and continue if droplet not found
-		log.Printf("Unable to get droplet for app. App %s App GUID %s Error %s",
-			app.Name, app.GUID, err)
+		return Droplet{}, false, fmt.Errorf("unable to get droplet for app: %s", err)
 	}
 	if len(droplets) != 1 {
 		// We should only have 1.
-		return Droplet{}, false
+		return Droplet{}, false, nil
 	}
-	return droplets[0], true
+	return droplets[0], true, nil
 }
 
-func findOutdatedApps(client *cfclient.Client, apps []App, buildpacks map[string]cfclient.Buildpack) (outdatedApps []App, updatedBuildpacks []buildpackReleaseInfo) {
+// needsDroplet checks whether the app is started and hasn't opted out, so its current droplet is checked.
+func needsDroplet(app App) bool {
+	return app.State == "STARTED" && !isOptedOut(app)
+}
+
+// getCurrentDropletsForApps gets the current droplets of the apps which need them, in the order of the apps.
+// The droplets of many apps are listed together, but the list can't be limited to current droplets. The current
+// droplet is always staged, so an app with only one staged droplet is using it. Apps with more than one staged
+// droplet, e.g. because older ones are kept for rollbacks, are decided from all of them when they agree about the
+// buildpacks, see agreeingDroplet. Only apps whose staged droplets disagree have their current droplet looked up
+// on its own.
+func getCurrentDropletsForApps(apps []App, buildpacks map[string]Buildpack, client *cfclient.Client, concurrency int) []dropletLookup {
+	lookups := make([]dropletLookup, len(apps))
+	var appGUIDs []string
 	for _, app := range apps {
+		if needsDroplet(app) {
+			appGUIDs = append(appGUIDs, app.GUID)
+		}
+	}
+	batches := batchGUIDs(appGUIDs)
+	batchDroplets := make([][]Droplet, len(batches))
+	batchErrs := make([]error, len(batches))
+	forEachConcurrently(len(batches), concurrency, func(i int) {
+		batchDroplets[i], batchErrs[i] = ListDropletsByQuery(client, url.Values{
+			"app_guids": []string{strings.Join(batches[i], ",")},
+			"states":    []string{"STAGED"},
+		})
+	})
+	stagedDroplets := make(map[string][]Droplet)
+	batchErrsByApp := make(map[string]error)
+	for i, batch := range batches {
+		for _, appGUID := range batch {
+			if batchErrs[i] != nil {
+				batchErrsByApp[appGUID] = fmt.Errorf("unable to get droplet for app: %s", batchErrs[i])
+			}
+		}
+		for _, droplet := range batchDroplets[i] {
+			appGUID := droplet.Relationships.App.Data.GUID
+			stagedDroplets[appGUID] = append(stagedDroplets[appGUID], droplet)
+		}
+	}
+	var ambiguous []int
+	for i, app := range apps {
+		if !needsDroplet(app) {
+			continue
+		}
+		if err := batchErrsByApp[app.GUID]; err != nil {
+			lookups[i].err = err
+			continue
+		}
+		switch droplets := stagedDroplets[app.GUID]; len(droplets) {
+		case 0:
+		case 1:
+			lookups[i].droplet, lookups[i].found = droplets[0], true
+		default:
+			if droplet, agree := agreeingDroplet(droplets, buildpacks); agree {
+				lookups[i].droplet, lookups[i].found = droplet, true
+			} else {
+				ambiguous = append(ambiguous, i)
+			}
+		}
+	}
+	forEachConcurrently(len(ambiguous), concurrency, func(j int) {
+		i := ambiguous[j]
+		lookups[i].droplet, lookups[i].found, lookups[i].err = getCurrentDropletForApp(apps[i], client)
+	})
+	return lookups
+}
+
+// agreeingDroplet checks whether the staged droplets of an app use the same supported buildpacks and are all outdated
+// or all up to date for each of them, so whichever is current leads to the same decision. It returns the newest of
+// the droplets, which is usually the current one and never overstates how old the current one is.
+func agreeingDroplet(droplets []Droplet, buildpacks map[string]Buildpack) (Droplet, bool) {
+	var newest Droplet
+	var newestCreatedAt time.Time
+	var firstVerdict string
+	for i, droplet := range droplets {
+		createdAt, err := time.Parse(time.RFC3339, droplet.CreatedAt)
+		if err != nil {
+			return Droplet{}, false
+		}
+		var verdict strings.Builder
+		for _, buildpack := range getSupportedBuildpacksOfDroplet(droplet, buildpacks) {
+			isOutdated, err := isDropletUsingOutdatedBuildpack(droplet, &buildpack)
+			if err != nil {
+				return Droplet{}, false
+			}
+			fmt.Fprintf(&verdict, "%s=%t;", buildpack.Name, isOutdated)
+		}
+		if i == 0 {
+			firstVerdict = verdict.String()
+		} else if verdict.String() != firstVerdict {
+			return Droplet{}, false
+		}
+		if i == 0 || createdAt.After(newestCreatedAt) {
+			newest, newestCreatedAt = droplet, createdAt
+		}
+	}
+	return newest, true
+}
+
+// findOutdatedApps gets the started apps whose current droplet is older than the buildpack it uses. Apps which
+// opted out of notices aren't checked.
+// Apps which can't be checked are left out and an error is returned for each of them.
+// The decision made about each app is added to the report, which may be nil.
+func findOutdatedApps(client *cfclient.Client, apps []App, buildpacks map[string]Buildpack, report *runReport, concurrency int) ([]notifyApp, error) {
+	var outdatedApps []notifyApp
+	var errs []error
+	now := time.Now()
+	// Getting the droplets is the slow part, so it is done in bulk before the apps are checked in order.
+	droplets := getCurrentDropletsForApps(apps, buildpacks, client, concurrency)
+	for i, app := range apps {
 		if app.State != "STARTED" {
 			log.Printf("App %s guid %s not in STARTED state\n", app.Name, app.GUID)
+			report.addApp(app, decisionNotStarted, nil)
+			continue
+		}
+		if isOptedOut(app) {
+			log.Printf("App %s guid %s opted out of notices\n", app.Name, app.GUID)
+			report.addApp(app, decisionOptedOut, nil)
+			continue
+		}
+		droplet, foundDroplet, err := droplets[i].droplet, droplets[i].found, droplets[i].err
+		if err != nil {
+			errs = append(errs, &appError{app.GUID, app.Name, "check", err})
+			report.addApp(app, decisionError, nil)
 			continue
 		}
-		droplet, foundDroplet := getCurrentDropletForApp(app, client)
 		if !foundDroplet {
 			log.Printf("Unable to find current droplet for app %s guid %s. Safely skipping.\n", app.Name, app.GUID)
+			report.addApp(app, decisionNoDroplet, nil)
 			continue
 		}
-		yes, buildpack := isDropletUsingSupportedBuildpack(droplet, buildpacks)
-		if !yes {
+		supportedBuildpacks := getSupportedBuildpacksOfDroplet(droplet, buildpacks)
+		if len(supportedBuildpacks) == 0 {
 			log.Printf("App %s guid %s not using supported buildpack\n", app.Name, app.GUID)
+			report.addApp(app, decisionUnsupportedBuildpack, nil)
 			continue
 		}
-		// If the app is using a supported buildpack, check if app is using an outdated buildpack.
-		if appIsOutdated := isDropletUsingOutdatedBuildpack(client, droplet, buildpack); !appIsOutdated {
-			log.Printf("App %s Guid %s | Buildpack %s not outdated\n", app.Name, app.GUID, buildpack.Name)
-			continue
-		} else {
-			// If the app is using an outdated buildpack, get the buildpack information to pass along to the user.
-			log.Printf("App %s Guid %s | Buildpack %s is outdated\n", app.Name, app.GUID, buildpack.Name)
-			buildpackReleaseURL := getBuildpackReleaseURL(buildpack.Name)
-			buildpackVersion := parseBuildpackVersion(buildpack.Filename)
-			buildpackVersionURL := getBuildpackVersionURL(buildpackReleaseURL, buildpackVersion)
-
-			updatedBuildpack := buildpackReleaseInfo{
-				BuildpackName:    buildpack.Name,
-				BuildpackVersion: buildpackVersion,
-				BuildpackURL:     buildpackVersionURL,
+		// If the app is using supported buildpacks, check each of them to see if the app is using an outdated one.
+		var outdatedBuildpacks []buildpackReleaseInfo
+		var checkErr error
+		for _, buildpack := range supportedBuildpacks {
+			releaseInfo := getBuildpackReleaseInfo(&buildpack)
+			isOutdated, err := isDropletUsingOutdatedBuildpack(droplet, &buildpack)
+			if err != nil {
+				checkErr = err
+				report.addApp(app, decisionError, &releaseInfo)
+				break
+			}
+			if !isOutdated {
+				log.Printf("App %s Guid %s | Buildpack %s not outdated\n", app.Name, app.GUID, buildpack.Name)
+				continue
 			}
+			log.Printf("App %s Guid %s | Buildpack %s is outdated\n", app.Name, app.GUID, buildpack.Name)
+			outdatedBuildpacks = append(outdatedBuildpacks, releaseInfo)
+		}
+		if checkErr != nil {
+			errs = append(errs, &appError{app.GUID, app.Name, "check", checkErr})
+			continue
+		}
+		if len(outdatedBuildpacks) == 0 {
+			releaseInfo := getBuildpackReleaseInfo(&supportedBuildpacks[0])
+			report.addApp(app, decisionUpToDate, &releaseInfo)
+			continue
+		}
+		// If the app is using outdated buildpacks, get the buildpack information to pass along to the user.
+		// The app has an entry for each outdated buildpack, so each buildpack update is tracked on its own.
+		report.addOutdatedApp(app, outdatedBuildpacks)
+		for _, releaseInfo := range outdatedBuildpacks {
+			outdatedApps = append(outdatedApps, notifyApp{
+				App:                app,
+				Buildpack:          releaseInfo,
+				OutdatedBuildpacks: outdatedBuildpacks,
+				DropletCreatedAt:   droplet.CreatedAt,
+				DropletAgeDays:     dropletAgeDays(droplet.CreatedAt, now),
+			})
+		}
+	}
+	return outdatedApps, errors.Join(errs...)
+}
+
+// getBuildpackReleaseInfo gets the version and release notes URL for a buildpack.
+func getBuildpackReleaseInfo(buildpack *Buildpack) buildpackReleaseInfo {
+	buildpackReleaseURL := getBuildpackReleaseURL(buildpack.Name)
+	buildpackVersion := parseBuildpackVersion(buildpack.Filename)
+	return buildpackReleaseInfo{
+		BuildpackName:      buildpack.Name,
+		BuildpackVersion:   buildpackVersion,
+		BuildpackURL:       getBuildpackVersionURL(buildpackReleaseURL, buildpackVersion),
+		BuildpackGUID:      buildpack.GUID,
+		BuildpackUpdatedAt: buildpack.UpdatedAt,
+	}
+}
 
-			updatedBuildpacks = append(updatedBuildpacks, updatedBuildpack)
+// groupAppsByGUID lists each app once, in the order of their first entries. Apps outdated by several buildpacks have
+// an entry for each of them, and the first is kept with all the outdated buildpacks of the app.
+func groupAppsByGUID(apps []notifyApp) []notifyApp {
+	var grouped []notifyApp
+	seen := make(map[string]bool)
+	for _, app := range apps {
+		if seen[app.GUID] {
+			continue
+		}
+		seen[app.GUID] = true
+		if len(app.OutdatedBuildpacks) == 0 {
+			app.OutdatedBuildpacks = []buildpackReleaseInfo{app.Buildpack}
 		}
-		outdatedApps = append(outdatedApps, app)
+		grouped = append(grouped, app)
+	}
+	return grouped
+}
+
+// getOutdatedBuildpacksOfApps gets the deduplicated buildpack releases that the grouped apps are outdated by.
+func getOutdatedBuildpacksOfApps(apps []notifyApp) []buildpackReleaseInfo {
+	buildpacks := []buildpackReleaseInfo{}
+	for _, app := range apps {
+		buildpacks = append(buildpacks, app.OutdatedBuildpacks...)
+	}
+	return deduplicateBuildpacks(buildpacks)
+}
+
+// newNotifyEmail creates the e-mail to the user about the apps. Each app is listed once with all its outdated
+// buildpacks, and only the release notes of those buildpacks are included.
+func newNotifyEmail(user string, apps []notifyApp) notifyEmail {
+	apps = groupAppsByGUID(apps)
+	return notifyEmail{user, apps, len(apps) > 1, getOutdatedBuildpacksOfApps(apps)}
+}
+
+// getBuildpacksOfApps gets the deduplicated buildpack releases that made the apps outdated.
+func getBuildpacksOfApps(apps []notifyApp) []buildpackReleaseInfo {
+	buildpacks := []buildpackReleaseInfo{}
+	for _, app := range apps {
+		buildpacks = append(buildpacks, app.Buildpack)
 	}
-	return
+	return deduplicateBuildpacks(buildpacks)
 }
 
-func spaceUserHasRoles(user cfclient.SpaceRole, roles map[string]bool) bool {
-	for _, roleOfUser := range user.SpaceRoles {
+func spaceUserHasRoles(user spaceUser, roles map[string]bool) bool {
+	for _, roleOfUser := range user.Roles {
 		if found, _ := roles[roleOfUser]; found {
 			return true
 		}
@@ -471,29 +1049,151 @@ func spaceUserHasRoles(user cfclient.SpaceRole, roles map[string]bool) bool {
 	return false
 }
 
-func sendNotifyEmailToUsers(users map[string][]cfclient.App, updatedBuildpacks []buildpackReleaseInfo, templates *Templates, mailer Mailer, dryRun bool) {
-	for user, apps := range users {
-		// Create buffer
-		body := new(bytes.Buffer)
-		// Determine whether the user has one application or more than one.
-		isMultipleApp := false
-		if len(apps) > 1 {
-			isMultipleApp = true
+// sortedRecipients gets the recipients of the e-mails in order, so e-mails are sent, and previewed, in the same
+// order on every run.
+func sortedRecipients(users map[string][]notifyApp) []string {
+	recipients := make([]string, 0, len(users))
+	for user := range users {
+		recipients = append(recipients, user)
+	}
+	sort.Strings(recipients)
+	return recipients
+}
+
+// sendNotifyEmailToUsers tells users about their outdated apps. It returns the number of e-mails sent
+// and an error for each e-mail which couldn't be sent.
+func sendNotifyEmailToUsers(users map[string][]notifyApp, templates *Templates, mailer Mailer, state *savedState, dryRun bool) (int, error) {
+	sent := 0
+	var errs []error
+	notifiedApps := state.notifiedApps()
+	for _, user := range sortedRecipients(users) {
+		apps := filterForAppsToNotify(user, users[user], state, notifiedApps)
+		if len(apps) == 0 {
+			log.Printf("Nothing new to notify user %s about\n", user)
+			continue
 		}
+		// Create buffers for the plain-text and HTML bodies
+		body := new(bytes.Buffer)
+		htmlBody := new(bytes.Buffer)
 		// Fill buffer with completed e-mail
-		templates.getNotifyEmail(body, notifyEmail{user, apps, isMultipleApp, updatedBuildpacks})
+		// Only tell the user about the buildpacks their own apps are using.
+		email := newNotifyEmail(user, apps)
+		err := templates.getNotifyEmail(body, email)
+		if err == nil {
+			err = templates.getNotifyEmailHTML(htmlBody, email)
+		}
+		if err != nil {
+			// Record the failure so the user is told once the template is fixed.
+			if !dryRun {
+				for _, app := range apps {
+					state.recordNotification(user, app, err)
+				}
+			}
+			errs = append(errs, fmt.Errorf("unable to fill in e-mail to %s: %s", user, err))
+			continue
+		}
 		// Send email
 		if !dryRun {
 			subj := "Action required: restage your application"
-			if isMultipleApp {
+			if email.IsMultipleApp {
 				subj += "s"
 			}
-			err := mailer.SendEmail(user, fmt.Sprint(subj), body.Bytes())
+			err = mailer.SendEmail(message.Email{To: user, Subject: subj, Text: body.Bytes(), HTML: htmlBody.Bytes()})
+			// Record the outcome so failed sends are retried and successful ones aren't repeated.
+			for _, app := range apps {
+				state.recordNotification(user, app, err)
+			}
 			if err != nil {
-				log.Printf("Unable to send e-mail to %s\n", user)
+				errs = append(errs, fmt.Errorf("unable to send e-mail to %s: %s", user, err))
 				continue
 			}
 		}
 		fmt.Printf("Sent e-mail to %s\n", user)
+		sent++
+	}
+	return sent, errors.Join(errs...)
+}
+
+// filterForAppsToNotify gets the apps the user still needs to be told about.
+// A user is told about an app once per buildpack release, unless sending failed.
+// Users without a record for an app which was already handled by an earlier run are not told,
+// because the release is only being checked again to retry failed notifications. Apps which were
+// missed by an earlier incomplete run have no records, so all of their owners are told.
+func filterForAppsToNotify(user string, apps []notifyApp, state *savedState, notifiedApps map[string]bool) []notifyApp {
+	var filteredApps []notifyApp
+	for _, app := range apps {
+		key := notificationKey(user, app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)
+		if record, found := state.Notifications[key]; found {
+			if record.SentAt == "" {
+				filteredApps = append(filteredApps, app)
+			}
+		} else if !notifiedApps[appReleaseKey(app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)] {
+			filteredApps = append(filteredApps, app)
+		}
+	}
+	return filteredApps
+}
+
+// filterForDueReminders gets the apps the user should be reminded about, leaving out apps whose reminders are
+// snoozed. It also returns how many reminders will have been sent about each app once the reminder goes out,
+// by appReleaseKey. firstNotified is the index from firstNotifiedTimes.
+func filterForDueReminders(user string, apps []notifyApp, state *savedState, reminderDays []int, now time.Time, firstNotified map[string]time.Time) ([]notifyApp, map[string]int) {
+	var dueApps []notifyApp
+	remindersSent := make(map[string]int)
+	for _, app := range apps {
+		if app.SnoozedUntil != "" {
+			continue
+		}
+		// Apps outdated by several buildpacks are at a different reminder for each of them.
+		if count, due := state.reminderDue(user, app, reminderDays, now, firstNotified); due {
+			dueApps = append(dueApps, app)
+			remindersSent[appReleaseKey(app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)] = count
+		}
+	}
+	return dueApps, remindersSent
+}
+
+// sendReminderEmailToUsers reminds users about apps which are still outdated after their owners were notified.
+// The apps passed in were all found to be outdated in this run, so apps which have been restaged since
+// the notification are never included. Apps whose reminders are snoozed are left out. It returns the number of
+// e-mails sent and an error for each e-mail which couldn't be sent.
+func sendReminderEmailToUsers(users map[string][]notifyApp, templates *Templates, mailer Mailer, state *savedState, reminderDays []int, dryRun bool) (int, error) {
+	sent := 0
+	var errs []error
+	now := time.Now()
+	firstNotified := state.firstNotifiedTimes()
+	for _, user := range sortedRecipients(users) {
+		apps, remindersSent := filterForDueReminders(user, users[user], state, reminderDays, now, firstNotified)
+		if len(apps) == 0 {
+			continue
+		}
+		body := new(bytes.Buffer)
+		email := newNotifyEmail(user, apps)
+		if err := templates.getReminderEmail(body, email); err != nil {
+			if !dryRun {
+				for _, app := range apps {
+					state.recordReminder(user, app, 0, err)
+				}
+			}
+			errs = append(errs, fmt.Errorf("unable to fill in reminder e-mail to %s: %s", user, err))
+			continue
+		}
+		if !dryRun {
+			subj := "Reminder: restage your application"
+			if email.IsMultipleApp {
+				subj += "s"
+			}
+			err := mailer.SendEmail(message.Email{To: user, Subject: subj, Text: body.Bytes()})
+			for _, app := range apps {
+				state.recordReminder(user, app, remindersSent[appReleaseKey(app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)], err)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to send reminder e-mail to %s: %s", user, err))
+				continue
+			}
+		}
+		fmt.Printf("Sent reminder e-mail to %s\n", user)
+		sent++
 	}
+	return sent, errors.Join(errs...)
 }
@@ -2,11 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/cloud-gov/buildpack-notify/message"
 	"github.com/cloud-gov/buildpack-notify/mocks"
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/stretchr/testify/mock"
@@ -16,13 +21,13 @@ func TestSpaceUserHasRoles(t *testing.T) {
 	testCases := []struct {
 		name         string
 		rolesToCheck map[string]bool
-		spaceUser    cfclient.SpaceRole
+		spaceUser    spaceUser
 		expected     bool
 	}{
-		{"role there", map[string]bool{"test": true}, cfclient.SpaceRole{SpaceRoles: []string{"test"}}, true},
-		{"role not there", map[string]bool{"test": true}, cfclient.SpaceRole{SpaceRoles: []string{""}}, false},
-		{"multiple roles not there", map[string]bool{"test1": true, "test2": true}, cfclient.SpaceRole{SpaceRoles: []string{"foo"}}, false},
-		{"multiple roles there", map[string]bool{"test1": true, "test2": true}, cfclient.SpaceRole{SpaceRoles: []string{"test2", "test"}}, true},
+		{"role there", map[string]bool{"test": true}, spaceUser{Roles: []string{"test"}}, true},
+		{"role not there", map[string]bool{"test": true}, spaceUser{Roles: []string{""}}, false},
+		{"multiple roles not there", map[string]bool{"test1": true, "test2": true}, spaceUser{Roles: []string{"foo"}}, false},
+		{"multiple roles there", map[string]bool{"test1": true, "test2": true}, spaceUser{Roles: []string{"test2", "test"}}, true},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -119,9 +124,40 @@ func TestBuildpackVersionURLWithBadVersion(t *testing.T) {
 	}
 }
 
-type spaceSpec struct {
-	space      cfclient.SpaceResource
-	spaceRoles cfclient.SpaceRoleResponse
+// newTestRoleResponse creates a V3 roles response with a role for each role of each user in the spaces.
+func newTestRoleResponse(spaces map[string][]spaceUser, spaceGUIDs []string, types map[string]bool) ListResponse[Role] {
+	var resp ListResponse[Role]
+	for _, spaceGUID := range spaceGUIDs {
+		for _, user := range spaces[spaceGUID] {
+			for _, roleType := range user.Roles {
+				if !types[roleType] {
+					continue
+				}
+				role := Role{GUID: spaceGUID + "-" + user.GUID + "-" + roleType, Type: roleType}
+				role.Relationships.User.Data.GUID = user.GUID
+				role.Relationships.Space.Data.GUID = spaceGUID
+				resp.Resources = append(resp.Resources, role)
+				resp.Included.Users = append(resp.Included.Users, User{GUID: user.GUID, Username: user.Username, Origin: user.Origin})
+			}
+		}
+	}
+	return resp
+}
+
+// newTestRolesHandler serves the V3 roles of the users in the spaces, and counts the requests.
+func newTestRolesHandler(t *testing.T, spaces map[string][]spaceUser, requests *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/v3/roles" || query.Get("include") != "user" || query.Get("space_guids") == "" {
+			t.Fatalf("Unable to find handler for %s", r.URL)
+		}
+		*requests++
+		types := make(map[string]bool)
+		for _, roleType := range strings.Split(query.Get("types"), ",") {
+			types[roleType] = true
+		}
+		json.NewEncoder(w).Encode(newTestRoleResponse(spaces, strings.Split(query.Get("space_guids"), ","), types))
+	}
 }
 
 const (
@@ -134,162 +170,127 @@ const (
 func TestFindOwnersOfApps(t *testing.T) {
 	testCases := []struct {
 		name     string
-		apps     cfclient.AppResponse
-		spaces   map[string]spaceSpec
-		expected map[string][]cfclient.App
+		apps     []App
+		spaces   map[string][]spaceUser
+		expected map[string][]App
 	}{
 		{
 			"single app, single user",
-			cfclient.AppResponse{Resources: []cfclient.AppResource{{Meta: cfclient.Meta{Guid: "app1"}, Entity: cfclient.App{SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}}}},
-			map[string]spaceSpec{
-				"space1": {
-					cfclient.SpaceResource{Meta: cfclient.Meta{Guid: "space1"}, Entity: cfclient.Space{}},
-					cfclient.SpaceRoleResponse{Resources: []cfclient.SpaceRoleResource{{Meta: cfclient.Meta{Guid: user1GUID}, Entity: cfclient.SpaceRole{Username: user1, SpaceRoles: []string{"space_manager"}}}}},
-				},
+			[]App{{GUID: "app1", Space: Space{GUID: "space1"}}},
+			map[string][]spaceUser{
+				"space1": {{GUID: user1GUID, Username: user1, Roles: []string{"space_manager"}}},
 			},
-			map[string][]cfclient.App{user1: []cfclient.App{cfclient.App{Guid: "app1", SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}}},
+			map[string][]App{user1: []App{{GUID: "app1", Space: Space{GUID: "space1"}}}},
 		},
 		{
 			"single app, single user multiple valid roles",
-			cfclient.AppResponse{Resources: []cfclient.AppResource{{Meta: cfclient.Meta{Guid: "app1"}, Entity: cfclient.App{SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}}}},
-			map[string]spaceSpec{
-				"space1": {
-					cfclient.SpaceResource{Meta: cfclient.Meta{Guid: "space1"}, Entity: cfclient.Space{}},
-					cfclient.SpaceRoleResponse{Resources: []cfclient.SpaceRoleResource{{Meta: cfclient.Meta{Guid: user1GUID}, Entity: cfclient.SpaceRole{Username: user1, SpaceRoles: []string{"space_manager", "space_developer"}}}}},
-				},
+			[]App{{GUID: "app1", Space: Space{GUID: "space1"}}},
+			map[string][]spaceUser{
+				"space1": {{GUID: user1GUID, Username: user1, Roles: []string{"space_manager", "space_developer"}}},
 			},
-			map[string][]cfclient.App{user1: []cfclient.App{cfclient.App{Guid: "app1", SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}}},
+			map[string][]App{user1: []App{{GUID: "app1", Space: Space{GUID: "space1"}}}},
 		},
 		{
 			"single app, single user one valid role, one invalid role",
-			cfclient.AppResponse{Resources: []cfclient.AppResource{{Meta: cfclient.Meta{Guid: "app1"}, Entity: cfclient.App{SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}}}},
-			map[string]spaceSpec{
-				"space1": {
-					cfclient.SpaceResource{Meta: cfclient.Meta{Guid: "space1"}, Entity: cfclient.Space{}},
-					cfclient.SpaceRoleResponse{Resources: []cfclient.SpaceRoleResource{{Meta: cfclient.Meta{Guid: user1GUID}, Entity: cfclient.SpaceRole{Username: user1, SpaceRoles: []string{"space_manager", "space_auditor"}}}}},
-				},
+			[]App{{GUID: "app1", Space: Space{GUID: "space1"}}},
+			map[string][]spaceUser{
+				"space1": {{GUID: user1GUID, Username: user1, Roles: []string{"space_manager", "space_auditor"}}},
 			},
-			map[string][]cfclient.App{user1: []cfclient.App{cfclient.App{Guid: "app1", SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}}},
+			map[string][]App{user1: []App{{GUID: "app1", Space: Space{GUID: "space1"}}}},
 		},
 		{
 			"single app, single user no valid role",
-			cfclient.AppResponse{Resources: []cfclient.AppResource{{Meta: cfclient.Meta{Guid: "app1"}, Entity: cfclient.App{SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}}}},
-			map[string]spaceSpec{
-				"space1": {
-					cfclient.SpaceResource{Meta: cfclient.Meta{Guid: "space1"}, Entity: cfclient.Space{}},
-					cfclient.SpaceRoleResponse{Resources: []cfclient.SpaceRoleResource{{Meta: cfclient.Meta{Guid: user1GUID}, Entity: cfclient.SpaceRole{Username: user1, SpaceRoles: []string{"space_auditor"}}}}},
-				},
+			[]App{{GUID: "app1", Space: Space{GUID: "space1"}}},
+			map[string][]spaceUser{
+				"space1": {{GUID: user1GUID, Username: user1, Roles: []string{"space_auditor"}}},
 			},
-			map[string][]cfclient.App{},
+			map[string][]App{},
 		},
 		{
 			"same single app, multiple users",
-			cfclient.AppResponse{Resources: []cfclient.AppResource{{Meta: cfclient.Meta{Guid: "app1"}, Entity: cfclient.App{SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}}}},
-			map[string]spaceSpec{
+			[]App{{GUID: "app1", Space: Space{GUID: "space1"}}},
+			map[string][]spaceUser{
 				"space1": {
-					cfclient.SpaceResource{Meta: cfclient.Meta{Guid: "space1"}, Entity: cfclient.Space{}},
-					cfclient.SpaceRoleResponse{Resources: []cfclient.SpaceRoleResource{
-						{Meta: cfclient.Meta{Guid: user1GUID}, Entity: cfclient.SpaceRole{Username: user1, SpaceRoles: []string{"space_manager"}}},
-						{Meta: cfclient.Meta{Guid: user2GUID}, Entity: cfclient.SpaceRole{Username: user2, SpaceRoles: []string{"space_manager"}}},
-					}},
+					{GUID: user1GUID, Username: user1, Roles: []string{"space_manager"}},
+					{GUID: user2GUID, Username: user2, Roles: []string{"space_manager"}},
 				},
 			},
-			map[string][]cfclient.App{
-				user1: []cfclient.App{cfclient.App{Guid: "app1", SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}},
-				user2: []cfclient.App{cfclient.App{Guid: "app1", SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}},
+			map[string][]App{
+				user1: []App{{GUID: "app1", Space: Space{GUID: "space1"}}},
+				user2: []App{{GUID: "app1", Space: Space{GUID: "space1"}}},
 			},
 		},
 		{
 			"same single app, multiple users, one without valid role",
-			cfclient.AppResponse{Resources: []cfclient.AppResource{{Meta: cfclient.Meta{Guid: "app1"}, Entity: cfclient.App{SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}}}},
-			map[string]spaceSpec{
+			[]App{{GUID: "app1", Space: Space{GUID: "space1"}}},
+			map[string][]spaceUser{
 				"space1": {
-					cfclient.SpaceResource{Meta: cfclient.Meta{Guid: "space1"}, Entity: cfclient.Space{}},
-					cfclient.SpaceRoleResponse{Resources: []cfclient.SpaceRoleResource{
-						{Meta: cfclient.Meta{Guid: user1GUID}, Entity: cfclient.SpaceRole{Username: user1, SpaceRoles: []string{"space_auditor"}}},
-						{Meta: cfclient.Meta{Guid: user2GUID}, Entity: cfclient.SpaceRole{Username: user2, SpaceRoles: []string{"space_manager"}}},
-					}},
+					{GUID: user1GUID, Username: user1, Roles: []string{"space_auditor"}},
+					{GUID: user2GUID, Username: user2, Roles: []string{"space_manager"}},
 				},
 			},
-			map[string][]cfclient.App{
-				user2: []cfclient.App{cfclient.App{Guid: "app1", SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}},
+			map[string][]App{
+				user2: []App{{GUID: "app1", Space: Space{GUID: "space1"}}},
 			},
 		},
 		{
 			"two apps in different spaces, two users, mutually exclusive app ownership",
-			cfclient.AppResponse{Resources: []cfclient.AppResource{
-				{Meta: cfclient.Meta{Guid: "app1"}, Entity: cfclient.App{SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}},
-				{Meta: cfclient.Meta{Guid: "app2"}, Entity: cfclient.App{SpaceURL: "/v2/spaces/space2", SpaceGuid: "space2"}},
-			}},
-			map[string]spaceSpec{
+			[]App{
+				{GUID: "app1", Space: Space{GUID: "space1"}},
+				{GUID: "app2", Space: Space{GUID: "space2"}},
+			},
+			map[string][]spaceUser{
 				"space1": {
-					cfclient.SpaceResource{Meta: cfclient.Meta{Guid: "space1"}, Entity: cfclient.Space{}},
-					cfclient.SpaceRoleResponse{Resources: []cfclient.SpaceRoleResource{
-						{Meta: cfclient.Meta{Guid: user1GUID}, Entity: cfclient.SpaceRole{Username: user1, SpaceRoles: []string{"space_manager"}}},
-					}},
+					{GUID: user1GUID, Username: user1, Roles: []string{"space_manager"}},
 				},
 				"space2": {
-					cfclient.SpaceResource{Meta: cfclient.Meta{Guid: "space2"}, Entity: cfclient.Space{}},
-					cfclient.SpaceRoleResponse{Resources: []cfclient.SpaceRoleResource{
-						{Meta: cfclient.Meta{Guid: user1GUID}, Entity: cfclient.SpaceRole{Username: user2, SpaceRoles: []string{"space_manager"}}},
-					}},
+					{GUID: user2GUID, Username: user2, Roles: []string{"space_manager"}},
 				},
 			},
-			map[string][]cfclient.App{
-				user1: []cfclient.App{cfclient.App{Guid: "app1", SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}},
-				user2: []cfclient.App{cfclient.App{Guid: "app2", SpaceURL: "/v2/spaces/space2", SpaceGuid: "space2"}},
+			map[string][]App{
+				user1: []App{{GUID: "app1", Space: Space{GUID: "space1"}}},
+				user2: []App{{GUID: "app2", Space: Space{GUID: "space2"}}},
 			},
 		},
 		{
 			"two apps in different spaces, two users with ownership in both spaces",
-			cfclient.AppResponse{Resources: []cfclient.AppResource{
-				{Meta: cfclient.Meta{Guid: "app1"}, Entity: cfclient.App{SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}},
-				{Meta: cfclient.Meta{Guid: "app2"}, Entity: cfclient.App{SpaceURL: "/v2/spaces/space2", SpaceGuid: "space2"}},
-			}},
-			map[string]spaceSpec{
+			[]App{
+				{GUID: "app1", Space: Space{GUID: "space1"}},
+				{GUID: "app2", Space: Space{GUID: "space2"}},
+			},
+			map[string][]spaceUser{
 				"space1": {
-					cfclient.SpaceResource{Meta: cfclient.Meta{Guid: "space1"}, Entity: cfclient.Space{}},
-					cfclient.SpaceRoleResponse{Resources: []cfclient.SpaceRoleResource{
-						{Meta: cfclient.Meta{Guid: user1GUID}, Entity: cfclient.SpaceRole{Username: user1, SpaceRoles: []string{"space_manager"}}},
-						{Meta: cfclient.Meta{Guid: user2GUID}, Entity: cfclient.SpaceRole{Username: user2, SpaceRoles: []string{"space_manager"}}},
-					}},
+					{GUID: user1GUID, Username: user1, Roles: []string{"space_manager"}},
+					{GUID: user2GUID, Username: user2, Roles: []string{"space_manager"}},
 				},
 				"space2": {
-					cfclient.SpaceResource{Meta: cfclient.Meta{Guid: "space2"}, Entity: cfclient.Space{}},
-					cfclient.SpaceRoleResponse{Resources: []cfclient.SpaceRoleResource{
-						{Meta: cfclient.Meta{Guid: user1GUID}, Entity: cfclient.SpaceRole{Username: user1, SpaceRoles: []string{"space_manager"}}},
-						{Meta: cfclient.Meta{Guid: user2GUID}, Entity: cfclient.SpaceRole{Username: user2, SpaceRoles: []string{"space_manager"}}},
-					}},
+					{GUID: user1GUID, Username: user1, Roles: []string{"space_manager"}},
+					{GUID: user2GUID, Username: user2, Roles: []string{"space_manager"}},
 				},
 			},
-			map[string][]cfclient.App{
-				user1: []cfclient.App{cfclient.App{Guid: "app1", SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}, cfclient.App{Guid: "app2", SpaceURL: "/v2/spaces/space2", SpaceGuid: "space2"}},
-				user2: []cfclient.App{cfclient.App{Guid: "app1", SpaceURL: "/v2/spaces/space1", SpaceGuid: "space1"}, cfclient.App{Guid: "app2", SpaceURL: "/v2/spaces/space2", SpaceGuid: "space2"}},
+			map[string][]App{
+				user1: []App{{GUID: "app1", Space: Space{GUID: "space1"}}, {GUID: "app2", Space: Space{GUID: "space2"}}},
+				user2: []App{{GUID: "app1", Space: Space{GUID: "space1"}}, {GUID: "app2", Space: Space{GUID: "space2"}}},
 			},
 		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				encoder := json.NewEncoder(w)
-				parts := strings.Split(r.URL.Path, "/")
-				if r.URL.Path == "/v2/apps" {
-					encoder.Encode(tc.apps)
-				} else if strings.HasSuffix(r.URL.Path, "user_roles") {
-					encoder.Encode(tc.spaces[parts[len(parts)-2]].spaceRoles)
-				} else if len(parts) >= 3 {
-					encoder.Encode(tc.spaces[parts[3]].space)
-				} else {
-					t.Fatalf("Unable to find handler for path %s", r.URL.Path)
-				}
-			}))
+			requests := 0
+			ts := httptest.NewServer(newTestRolesHandler(t, tc.spaces, &requests))
 			defer ts.Close()
 			c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
-			apps, err := c.ListApps()
+			notifyApps := []notifyApp{}
+			for _, app := range tc.apps {
+				notifyApps = append(notifyApps, notifyApp{App: app})
+			}
+			actual, err := findOwnersOfApps(notifyApps, []string{"space_manager", "space_developer"}, nil, &c, 4)
 			if err != nil {
-				t.Fatal(err)
+				t.Fatalf("Test %s failed. Unable to find owners. Error: %s", tc.name, err.Error())
+			}
+			if requests != 1 {
+				t.Errorf("Test %s failed. Expected the roles of all spaces in 1 request, made %d", tc.name, requests)
 			}
-			actual := findOwnersOfApps(apps, &c)
 			if len(actual) != len(tc.expected) {
 				t.Errorf("Test %s failed. Expected %d user entries, only found %d\n", tc.name, len(tc.expected), len(actual))
 			}
@@ -307,12 +308,12 @@ func TestFindOwnersOfApps(t *testing.T) {
 				for _, actualOutdatedApp := range actualOutdatedApps {
 					found := false
 					for _, expectedOutdatedApp := range expectedOutdatedApps {
-						if expectedOutdatedApp.Guid == actualOutdatedApp.Guid {
+						if expectedOutdatedApp.GUID == actualOutdatedApp.GUID {
 							found = true
 						}
 					}
 					if !found {
-						t.Errorf("Test %s failed. Looked for app with guid %s, Could not find it", tc.name, actualOutdatedApp.Guid)
+						t.Errorf("Test %s failed. Looked for app with guid %s, Could not find it", tc.name, actualOutdatedApp.GUID)
 					}
 				}
 			}
@@ -320,51 +321,190 @@ func TestFindOwnersOfApps(t *testing.T) {
 	}
 }
 
+func TestFindOwnersOfAppsWithConfiguredRoles(t *testing.T) {
+	spaces := map[string][]spaceUser{
+		"space1": {
+			{GUID: user1GUID, Username: user1, Origin: "uaa", Roles: []string{"space_manager"}},
+			{GUID: user2GUID, Username: user2, Origin: "sso", Roles: []string{"space_auditor"}},
+			{GUID: "supporter-guid", Username: "supporter@example.com", Origin: "uaa", Roles: []string{"space_supporter"}},
+		},
+	}
+	orgManagers := ListResponse[Role]{Resources: []Role{{GUID: "role-guid", Type: "organization_manager"}}}
+	orgManagers.Resources[0].Relationships.User.Data.GUID = "manager-guid"
+	orgManagers.Resources[0].Relationships.Organization.Data.GUID = "org1"
+	orgManagers.Included.Users = []User{{GUID: "manager-guid", Username: "manager@example.com", Origin: "sso"}}
+	requests := 0
+	spaceRoles := newTestRolesHandler(t, spaces, &requests)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path == "/v3/roles" && query.Get("organization_guids") == "org1" && query.Get("types") == "organization_manager" {
+			json.NewEncoder(w).Encode(orgManagers)
+			return
+		}
+		spaceRoles(w, r)
+	}))
+	defer ts.Close()
+	c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
+	app := notifyApp{App: App{GUID: "app1", Space: Space{GUID: "space1"}, Org: Organization{GUID: "org1"}}}
+
+	testCases := []struct {
+		name     string
+		roles    []string
+		origins  []string
+		expected []string
+	}{
+		{"managers only", []string{"space_manager"}, nil, []string{user1}},
+		{"auditors", []string{"space_manager", "space_auditor"}, nil, []string{user1, user2}},
+		{"supporters", []string{"space_supporter"}, nil, []string{"supporter@example.com"}},
+		{"org managers", []string{"org_manager"}, nil, []string{"manager@example.com"}},
+		{"space and org roles", []string{"space_auditor", "org_manager"}, nil, []string{user2, "manager@example.com"}},
+		{"uaa users", []string{"space_manager", "space_auditor", "org_manager"}, []string{"uaa"}, []string{user1}},
+		{"sso users", []string{"space_manager", "space_auditor", "org_manager"}, []string{"sso"}, []string{user2, "manager@example.com"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := findOwnersOfApps([]notifyApp{app}, tc.roles, tc.origins, &c, 4)
+			if err != nil {
+				t.Fatalf("Test %s failed. Unable to find owners. Error: %s", tc.name, err.Error())
+			}
+			if len(actual) != len(tc.expected) {
+				t.Errorf("Test %s failed. Expected %d user entries, found %+v\n", tc.name, len(tc.expected), actual)
+			}
+			for _, username := range tc.expected {
+				if len(actual[username]) != 1 {
+					t.Errorf("Test %s failed. Expected %s to own the app\n", tc.name, username)
+				}
+			}
+		})
+	}
+}
+
+func TestFindOwnersOfAppsBatchesSpaces(t *testing.T) {
+	spaces := make(map[string][]spaceUser)
+	var apps []notifyApp
+	for i := 0; i < filterBatchSize+1; i++ {
+		spaceGUID := fmt.Sprintf("space%d", i)
+		spaces[spaceGUID] = []spaceUser{{GUID: user1GUID, Username: user1, Roles: []string{"space_manager"}}}
+		apps = append(apps, notifyApp{App: App{GUID: fmt.Sprintf("app%d", i), Space: Space{GUID: spaceGUID}}})
+	}
+	requests := 0
+	ts := httptest.NewServer(newTestRolesHandler(t, spaces, &requests))
+	defer ts.Close()
+	c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
+
+	owners, err := findOwnersOfApps(apps, []string{"space_manager"}, nil, &c, 1)
+	if err != nil {
+		t.Fatalf("Unable to find owners. Error: %s", err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected the roles of %d spaces in 2 requests, made %d", len(apps), requests)
+	}
+	if len(owners[user1]) != len(apps) {
+		t.Errorf("Expected %s to own %d apps, found %d", user1, len(apps), len(owners[user1]))
+	}
+}
+
+func TestFindOwnersOfAppsWithContacts(t *testing.T) {
+	spaces := map[string][]spaceUser{
+		"space1": {{GUID: user1GUID, Username: user1, Roles: []string{"space_developer"}}},
+		"space2": {{GUID: user2GUID, Username: user2, Roles: []string{"space_developer"}}},
+	}
+	var spaceFilters []string
+	roles := newTestRolesHandler(t, spaces, new(int))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spaceFilters = append(spaceFilters, r.URL.Query().Get("space_guids"))
+		roles(w, r)
+	}))
+	defer ts.Close()
+	c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
+	contact := Metadata{Annotations: map[string]string{contactAnnotation: "team@agency.gov"}}
+	apps := []notifyApp{
+		{App: App{GUID: "app1", Space: Space{GUID: "space1"}}},
+		{App: App{GUID: "app2", Space: Space{GUID: "space1"}, Metadata: contact}},
+		{App: App{GUID: "app3", Space: Space{GUID: "space2", Metadata: contact}}},
+	}
+
+	owners, err := findOwnersOfApps(apps, []string{"space_developer"}, nil, &c, 4)
+	if err != nil {
+		t.Fatalf("Unable to find owners. Error: %s", err)
+	}
+	expected := map[string][]string{user1: {"app1"}, "team@agency.gov": {"app2", "app3"}}
+	if len(owners) != len(expected) {
+		t.Errorf("Expected owners %v, found %+v", expected, owners)
+	}
+	for username, appGUIDs := range expected {
+		var actual []string
+		for _, app := range owners[username] {
+			actual = append(actual, app.GUID)
+		}
+		if !reflect.DeepEqual(actual, appGUIDs) {
+			t.Errorf("Expected %s to own %v, found %v", username, appGUIDs, actual)
+		}
+	}
+	if !reflect.DeepEqual(spaceFilters, []string{"space1"}) {
+		t.Errorf("Expected only the roles of spaces with apps without contacts to be looked up, found %v", spaceFilters)
+	}
+}
+
+func TestValidateRecipientRoles(t *testing.T) {
+	if err := validateRecipientRoles([]string{"space_manager", "space_supporter", "org_auditor"}); err != nil {
+		t.Errorf("Expected roles to be valid. Error %s", err)
+	}
+	if err := validateRecipientRoles([]string{"space_manager", "admin"}); err == nil {
+		t.Error("Expected unknown role to be invalid")
+	}
+}
+
 type testNotifyEmail struct {
 	notifyEmail
 	subject string
 }
 
 func TestSendNotifyEmailToUsers(t *testing.T) {
-	updatedBuildpacks := []buildpackReleaseInfo{
-		{
-			"java_buildpack",
-			"v4.41",
-			"https://github.com/cloudfoundry/java-buildpack/releases/tags/v4.41",
-		},
-		{
-			"python_buildpack",
-			"v1.7.43",
-			"https://github.com/cloudfoundry/python-buildpack/releases/tags/v1.7.43",
-		},
-		{
-			"ruby_buildpack",
-			"v1.8.43",
-			"https://github.com/cloudfoundry/ruby-buildpack/releases/tags/v1.8.43",
-		},
+	javaBuildpack := buildpackReleaseInfo{
+		"java_buildpack",
+		"v4.41",
+		"https://github.com/cloudfoundry/java-buildpack/releases/tags/v4.41",
+		"java-guid",
+		"2016-06-08T16:41:45Z",
+	}
+	pythonBuildpack := buildpackReleaseInfo{
+		"python_buildpack",
+		"v1.7.43",
+		"https://github.com/cloudfoundry/python-buildpack/releases/tags/v1.7.43",
+		"python-guid",
+		"2016-06-08T16:41:45Z",
 	}
+	rubyBuildpack := buildpackReleaseInfo{
+		"ruby_buildpack",
+		"v1.8.43",
+		"https://github.com/cloudfoundry/ruby-buildpack/releases/tags/v1.8.43",
+		"ruby-guid",
+		"2016-06-08T16:41:45Z",
+	}
+	allBuildpacks := []buildpackReleaseInfo{javaBuildpack, pythonBuildpack, rubyBuildpack}
 
 	testCases := []struct {
 		name          string
-		usersAndApps  map[string][]cfclient.App
+		usersAndApps  map[string][]notifyApp
 		expectedCalls []testNotifyEmail
 	}{
 		{
 			"single user, single app",
-			map[string][]cfclient.App{
-				"james@example.com": []cfclient.App{
-					{Name: "testapp"},
+			map[string][]notifyApp{
+				"james@example.com": []notifyApp{
+					{App: App{GUID: "app", Name: "testapp"}, Buildpack: pythonBuildpack},
 				},
 			},
 			[]testNotifyEmail{
 				{
 					notifyEmail{
 						"james@example.com",
-						[]cfclient.App{
-							{Name: "testapp"},
+						[]notifyApp{
+							{App: App{GUID: "app", Name: "testapp"}, Buildpack: pythonBuildpack},
 						},
 						false,
-						updatedBuildpacks,
+						[]buildpackReleaseInfo{pythonBuildpack},
 					},
 					"Action required: restage your application",
 				},
@@ -372,22 +512,22 @@ func TestSendNotifyEmailToUsers(t *testing.T) {
 		},
 		{
 			"single user, multiple apps",
-			map[string][]cfclient.App{
-				"james@example.com": []cfclient.App{
-					{Name: "testapp1"},
-					{Name: "testapp2"},
+			map[string][]notifyApp{
+				"james@example.com": []notifyApp{
+					{App: App{GUID: "app1", Name: "testapp1"}, Buildpack: pythonBuildpack},
+					{App: App{GUID: "app2", Name: "testapp2"}, Buildpack: javaBuildpack},
 				},
 			},
 			[]testNotifyEmail{
 				{
 					notifyEmail{
 						"james@example.com",
-						[]cfclient.App{
-							{Name: "testapp1"},
-							{Name: "testapp2"},
+						[]notifyApp{
+							{App: App{GUID: "app1", Name: "testapp1"}, Buildpack: pythonBuildpack},
+							{App: App{GUID: "app2", Name: "testapp2"}, Buildpack: javaBuildpack},
 						},
 						true,
-						updatedBuildpacks,
+						[]buildpackReleaseInfo{pythonBuildpack, javaBuildpack},
 					},
 					"Action required: restage your applications",
 				},
@@ -395,34 +535,34 @@ func TestSendNotifyEmailToUsers(t *testing.T) {
 		},
 		{
 			"multiple users, each with a single app",
-			map[string][]cfclient.App{
-				"james@example.com": []cfclient.App{
-					{Name: "testapp1"},
+			map[string][]notifyApp{
+				"james@example.com": []notifyApp{
+					{App: App{GUID: "app1", Name: "testapp1"}, Buildpack: pythonBuildpack},
 				},
-				"bob@example.com": []cfclient.App{
-					{Name: "testapp2"},
+				"bob@example.com": []notifyApp{
+					{App: App{GUID: "app2", Name: "testapp2"}, Buildpack: javaBuildpack},
 				},
 			},
 			[]testNotifyEmail{
 				{
 					notifyEmail{
 						"james@example.com",
-						[]cfclient.App{
-							{Name: "testapp1"},
+						[]notifyApp{
+							{App: App{GUID: "app1", Name: "testapp1"}, Buildpack: pythonBuildpack},
 						},
 						false,
-						updatedBuildpacks,
+						[]buildpackReleaseInfo{pythonBuildpack},
 					},
 					"Action required: restage your application",
 				},
 				{
 					notifyEmail{
 						"bob@example.com",
-						[]cfclient.App{
-							{Name: "testapp2"},
+						[]notifyApp{
+							{App: App{GUID: "app2", Name: "testapp2"}, Buildpack: javaBuildpack},
 						},
 						false,
-						updatedBuildpacks,
+						[]buildpackReleaseInfo{javaBuildpack},
 					},
 					"Action required: restage your application",
 				},
@@ -430,38 +570,38 @@ func TestSendNotifyEmailToUsers(t *testing.T) {
 		},
 		{
 			"multiple users, each with multiple apps",
-			map[string][]cfclient.App{
-				"james@example.com": []cfclient.App{
-					{Name: "testapp1"},
-					{Name: "testapp2"},
+			map[string][]notifyApp{
+				"james@example.com": []notifyApp{
+					{App: App{GUID: "app1", Name: "testapp1"}, Buildpack: pythonBuildpack},
+					{App: App{GUID: "app2", Name: "testapp2"}, Buildpack: javaBuildpack},
 				},
-				"bob@example.com": []cfclient.App{
-					{Name: "testapp3"},
-					{Name: "testapp4"},
+				"bob@example.com": []notifyApp{
+					{App: App{GUID: "app3", Name: "testapp3"}, Buildpack: rubyBuildpack},
+					{App: App{GUID: "app4", Name: "testapp4"}, Buildpack: rubyBuildpack},
 				},
 			},
 			[]testNotifyEmail{
 				{
 					notifyEmail{
 						"james@example.com",
-						[]cfclient.App{
-							{Name: "testapp1"},
-							{Name: "testapp2"},
+						[]notifyApp{
+							{App: App{GUID: "app1", Name: "testapp1"}, Buildpack: pythonBuildpack},
+							{App: App{GUID: "app2", Name: "testapp2"}, Buildpack: javaBuildpack},
 						},
 						true,
-						updatedBuildpacks,
+						[]buildpackReleaseInfo{pythonBuildpack, javaBuildpack},
 					},
 					"Action required: restage your applications",
 				},
 				{
 					notifyEmail{
 						"bob@example.com",
-						[]cfclient.App{
-							{Name: "testapp3"},
-							{Name: "testapp4"},
+						[]notifyApp{
+							{App: App{GUID: "app3", Name: "testapp3"}, Buildpack: rubyBuildpack},
+							{App: App{GUID: "app4", Name: "testapp4"}, Buildpack: rubyBuildpack},
 						},
 						true,
-						updatedBuildpacks,
+						[]buildpackReleaseInfo{rubyBuildpack},
 					},
 					"Action required: restage your applications",
 				},
@@ -473,8 +613,8 @@ func TestSendNotifyEmailToUsers(t *testing.T) {
 		templates, _ := initTemplates()
 		t.Run(tc.name, func(t *testing.T) {
 			mockMailer := new(mocks.Mailer)
-			mockMailer.On("SendEmail", mock.Anything, mock.Anything, mock.Anything).Return(nil)
-			sendNotifyEmailToUsers(tc.usersAndApps, updatedBuildpacks, templates, mockMailer, false)
+			mockMailer.On("SendEmail", mock.Anything).Return(nil)
+			sendNotifyEmailToUsers(tc.usersAndApps, templates, mockMailer, newSavedState(), false)
 			if !mockMailer.AssertNumberOfCalls(t, "SendEmail", len(tc.expectedCalls)) {
 				t.Errorf("Did not call send e-mail the number of expected times")
 				t.Log(len(mockMailer.Calls))
@@ -482,13 +622,16 @@ func TestSendNotifyEmailToUsers(t *testing.T) {
 			count := 0
 			for _, expectedCall := range tc.expectedCalls {
 				for _, call := range mockMailer.Calls {
-					if call.Method == "SendEmail" && call.Arguments.String(0) == expectedCall.Username {
-						if call.Arguments.String(1) != expectedCall.subject {
-							t.Errorf("Failed to match subject line. Found %s, Expected %s", call.Arguments.String(1), expectedCall.subject)
+					email := call.Arguments.Get(0).(message.Email)
+					if call.Method == "SendEmail" && email.To == expectedCall.Username {
+						if email.Subject != expectedCall.subject {
+							t.Errorf("Failed to match subject line. Found %s, Expected %s", email.Subject, expectedCall.subject)
 							continue
 						}
-						raw := call.Arguments.Get(2).([]byte)
-						rawString := string(raw)
+						if len(email.HTML) == 0 {
+							t.Errorf("Expected an HTML body in the e-mail to %s", email.To)
+						}
+						rawString := string(email.Text)
 						foundApps := true
 						for _, app := range expectedCall.Apps {
 							if !strings.Contains(rawString, app.Name) {
@@ -496,6 +639,19 @@ func TestSendNotifyEmailToUsers(t *testing.T) {
 								foundApps = false
 							}
 						}
+						// Only the buildpacks used by the user's apps should be in the e-mail.
+						for _, buildpack := range allBuildpacks {
+							expected := false
+							for _, expectedBuildpack := range expectedCall.Buildpacks {
+								if expectedBuildpack == buildpack {
+									expected = true
+								}
+							}
+							if expected != strings.Contains(rawString, buildpack.BuildpackURL) {
+								t.Errorf("Expected buildpack %s in e-mail to be %v", buildpack.BuildpackName, expected)
+								foundApps = false
+							}
+						}
 						if foundApps {
 							count++
 						}
@@ -509,3 +665,221 @@ func TestSendNotifyEmailToUsers(t *testing.T) {
 		})
 	}
 }
+
+func TestSendNotifyEmailToUsersRecordsHistory(t *testing.T) {
+	pythonBuildpack := buildpackReleaseInfo{
+		"python_buildpack",
+		"v1.7.43",
+		"https://github.com/cloudfoundry/python-buildpack/releases/tags/v1.7.43",
+		"python-guid",
+		"2016-06-08T16:41:45Z",
+	}
+	app := notifyApp{App: App{GUID: "app1", Name: "testapp"}, Buildpack: pythonBuildpack}
+	users := map[string][]notifyApp{
+		user1: {app},
+		user2: {app},
+	}
+	templates, _ := initTemplates()
+	state := newSavedState()
+
+	// The first run fails to send to user1.
+	mockMailer := new(mocks.Mailer)
+	mockMailer.On("SendEmail", emailTo(user1)).Return(errors.New("smtp unavailable"))
+	mockMailer.On("SendEmail", emailTo(user2)).Return(nil)
+	sendNotifyEmailToUsers(users, templates, mockMailer, state, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 2)
+	failed := state.Notifications[notificationKey(user1, "app1", "python-guid", "2016-06-08T16:41:45Z")]
+	if failed.SentAt != "" || failed.LastError != "smtp unavailable" || failed.Attempts != 1 {
+		t.Errorf("Expected failed notification to be recorded. Actual %+v", failed)
+	}
+	sent := state.Notifications[notificationKey(user2, "app1", "python-guid", "2016-06-08T16:41:45Z")]
+	if sent.SentAt == "" || sent.Attempts != 1 {
+		t.Errorf("Expected sent notification to be recorded. Actual %+v", sent)
+	}
+	if !state.hasPendingNotifications("python-guid", "2016-06-08T16:41:45Z") {
+		t.Error("Expected the buildpack release to have pending notifications")
+	}
+
+	// The second run only retries user1. user3 joined the space after the release was handled.
+	const user3 = "user3@example.com"
+	users[user3] = []notifyApp{app}
+	mockMailer = new(mocks.Mailer)
+	mockMailer.On("SendEmail", emailTo(user1)).Return(nil)
+	sendNotifyEmailToUsers(users, templates, mockMailer, state, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 1)
+	retried := state.Notifications[notificationKey(user1, "app1", "python-guid", "2016-06-08T16:41:45Z")]
+	if retried.SentAt == "" || retried.LastError != "" || retried.Attempts != 2 {
+		t.Errorf("Expected retried notification to be recorded. Actual %+v", retried)
+	}
+	if state.hasPendingNotifications("python-guid", "2016-06-08T16:41:45Z") {
+		t.Error("Expected the buildpack release to have no pending notifications")
+	}
+
+	// The third run doesn't send anything.
+	mockMailer = new(mocks.Mailer)
+	sendNotifyEmailToUsers(users, templates, mockMailer, state, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 0)
+
+	// An app which an incomplete run missed has no records, so its owners are told about it.
+	missedApp := notifyApp{App: App{GUID: "app2", Name: "missedapp"}, Buildpack: pythonBuildpack}
+	mockMailer = new(mocks.Mailer)
+	mockMailer.On("SendEmail", emailTo(user3)).Return(nil)
+	sendNotifyEmailToUsers(map[string][]notifyApp{user3: {app, missedApp}}, templates, mockMailer, state, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 1)
+	if _, found := state.Notifications[notificationKey(user3, "app1", "python-guid", "2016-06-08T16:41:45Z")]; found {
+		t.Error("Expected user3 not to be told about app1")
+	}
+}
+
+func TestSendEmailsRecordTemplateErrors(t *testing.T) {
+	pythonBuildpack := buildpackReleaseInfo{BuildpackName: "python_buildpack", BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}
+	users := map[string][]notifyApp{user1: {{App: App{GUID: "app1", Name: "testapp"}, Buildpack: pythonBuildpack}}}
+	key := notificationKey(user1, "app1", "python-guid", "2016-06-08T16:41:45Z")
+	// No templates are loaded, so filling in any e-mail fails.
+	templates := &Templates{}
+	testCases := []struct {
+		name    string
+		send    func(state *savedState, mailer Mailer) (int, error)
+		records func(state *savedState) map[string]notificationRecord
+	}{
+		{"notify", func(state *savedState, mailer Mailer) (int, error) {
+			return sendNotifyEmailToUsers(users, templates, mailer, state, false)
+		}, func(state *savedState) map[string]notificationRecord { return state.Notifications }},
+		{"reminder", func(state *savedState, mailer Mailer) (int, error) {
+			return sendReminderEmailToUsers(users, templates, mailer, state, []int{7}, false)
+		}, func(state *savedState) map[string]notificationRecord { return state.reminderAttempts() }},
+		{"escalation", func(state *savedState, mailer Mailer) (int, error) {
+			return sendEscalationEmailToUsers(users, templates, mailer, state, 30, false)
+		}, func(state *savedState) map[string]notificationRecord { return state.Escalations }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := newSavedState()
+			if tc.name != "notify" {
+				state.Notifications[key] = notificationRecord{
+					Recipient: user1, AppGUID: "app1", BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z",
+					Attempts: 1, SentAt: time.Now().Add(-40 * 24 * time.Hour).UTC().Format(time.RFC3339),
+				}
+			}
+			mockMailer := new(mocks.Mailer)
+			sent, err := tc.send(state, mockMailer)
+			mockMailer.AssertNumberOfCalls(t, "SendEmail", 0)
+			if sent != 0 || err == nil {
+				t.Errorf("Test %s failed. Expected no e-mails and an error. Actual %d, %v", tc.name, sent, err)
+			}
+			record := tc.records(state)[key]
+			if record.SentAt != "" || record.LastError == "" || record.Attempts != 1 {
+				t.Errorf("Test %s failed. Expected the failure to be recorded so it is retried. Actual %+v", tc.name, record)
+			}
+		})
+	}
+}
+
+func TestPruneNotifications(t *testing.T) {
+	state := newSavedState()
+	app := notifyApp{App: App{GUID: "app1"}, Buildpack: buildpackReleaseInfo{BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}}
+	state.recordNotification(user1, app, nil)
+	state.pruneNotifications([]Buildpack{{GUID: "python-guid", UpdatedAt: "2016-06-08T16:41:45Z"}})
+	if len(state.Notifications) != 1 {
+		t.Errorf("Expected notification for current release to be kept. Actual %+v", state.Notifications)
+	}
+	state.pruneNotifications([]Buildpack{{GUID: "python-guid", UpdatedAt: "2017-06-08T16:41:45Z"}})
+	if len(state.Notifications) != 0 {
+		t.Errorf("Expected notification for old release to be removed. Actual %+v", state.Notifications)
+	}
+}
+
+func TestSendReminderEmailToUsers(t *testing.T) {
+	pythonBuildpack := buildpackReleaseInfo{
+		"python_buildpack",
+		"v1.7.43",
+		"https://github.com/cloudfoundry/python-buildpack/releases/tags/v1.7.43",
+		"python-guid",
+		"2016-06-08T16:41:45Z",
+	}
+	app := notifyApp{App: App{GUID: "app1", Name: "testapp"}, Buildpack: pythonBuildpack}
+	users := map[string][]notifyApp{
+		user1: {app},
+		user2: {app},
+	}
+	templates, _ := initTemplates()
+	state := newSavedState()
+	// app1 was first notified about 8 days ago, app2 yesterday.
+	state.Notifications[notificationKey(user1, "app1", "python-guid", "2016-06-08T16:41:45Z")] = notificationRecord{
+		Recipient: user1, AppGUID: "app1", BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z",
+		Attempts: 1, SentAt: time.Now().Add(-8 * 24 * time.Hour).UTC().Format(time.RFC3339),
+	}
+	state.Notifications[notificationKey(user2, "app2", "python-guid", "2016-06-08T16:41:45Z")] = notificationRecord{
+		Recipient: user2, AppGUID: "app2", BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z",
+		Attempts: 1, SentAt: time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339),
+	}
+	// user2 is reminded about app1 even though they weren't notified about it, e.g. because
+	// reminders go to different roles.
+	users[user2] = []notifyApp{app, {App: App{GUID: "app2", Name: "testapp2"}, Buildpack: pythonBuildpack}}
+	if !state.hasDueReminders("python-guid", "2016-06-08T16:41:45Z", []int{7, 14}, time.Now(), state.firstNotifiedTimes(), state.remindersSentCounts()) {
+		t.Error("Expected reminders to be due")
+	}
+
+	mockMailer := new(mocks.Mailer)
+	mockMailer.On("SendEmail", mock.MatchedBy(func(email message.Email) bool {
+		return email.Subject == "Reminder: restage your application"
+	})).Return(nil)
+	sendReminderEmailToUsers(users, templates, mockMailer, state, []int{7, 14}, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 2)
+	reminded := state.Reminders[notificationKey(user1, "app1", "python-guid", "2016-06-08T16:41:45Z")]
+	if reminded.RemindersSent != 1 || reminded.SentAt == "" {
+		t.Errorf("Expected reminder to be recorded. Actual %+v", reminded)
+	}
+
+	if state.hasDueReminders("python-guid", "2016-06-08T16:41:45Z", []int{7, 14}, time.Now(), state.firstNotifiedTimes(), state.remindersSentCounts()) {
+		t.Error("Expected no reminders to be due")
+	}
+
+	// The next reminder isn't due yet.
+	mockMailer = new(mocks.Mailer)
+	sendReminderEmailToUsers(users, templates, mockMailer, state, []int{7, 14}, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 0)
+}
+
+func TestSendReminderEmailToUsersWithMultipleBuildpacks(t *testing.T) {
+	nodejsBuildpack := buildpackReleaseInfo{BuildpackName: "nodejs_buildpack", BuildpackGUID: "nodejs-guid", BuildpackUpdatedAt: "2016-05-01T00:00:00Z"}
+	pythonBuildpack := buildpackReleaseInfo{BuildpackName: "python_buildpack", BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}
+	outdatedBuildpacks := []buildpackReleaseInfo{nodejsBuildpack, pythonBuildpack}
+	app := App{GUID: "app1", Name: "testapp"}
+	users := map[string][]notifyApp{user1: {
+		{App: app, Buildpack: nodejsBuildpack, OutdatedBuildpacks: outdatedBuildpacks},
+		{App: app, Buildpack: pythonBuildpack, OutdatedBuildpacks: outdatedBuildpacks},
+	}}
+	state := newSavedState()
+	// The app was first notified about the nodejs buildpack 31 days ago and the python buildpack 8 days ago.
+	for buildpack, daysAgo := range map[buildpackReleaseInfo]int{nodejsBuildpack: 31, pythonBuildpack: 8} {
+		state.Notifications[notificationKey(user1, "app1", buildpack.BuildpackGUID, buildpack.BuildpackUpdatedAt)] = notificationRecord{
+			Recipient: user1, AppGUID: "app1", BuildpackGUID: buildpack.BuildpackGUID, BuildpackUpdatedAt: buildpack.BuildpackUpdatedAt,
+			Attempts: 1, SentAt: time.Now().Add(-time.Duration(daysAgo) * 24 * time.Hour).UTC().Format(time.RFC3339),
+		}
+	}
+	templates, _ := initTemplates()
+
+	mockMailer := new(mocks.Mailer)
+	mockMailer.On("SendEmail", mock.Anything).Return(nil)
+	sendReminderEmailToUsers(users, templates, mockMailer, state, []int{7, 14, 30}, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 1)
+	for buildpack, expected := range map[buildpackReleaseInfo]int{nodejsBuildpack: 3, pythonBuildpack: 1} {
+		reminded := state.Reminders[notificationKey(user1, "app1", buildpack.BuildpackGUID, buildpack.BuildpackUpdatedAt)]
+		if reminded.RemindersSent != expected {
+			t.Errorf("Expected %d reminders about %s to be recorded. Actual %+v", expected, buildpack.BuildpackName, reminded)
+		}
+	}
+
+	// No reminder is due about either buildpack on the next run.
+	mockMailer = new(mocks.Mailer)
+	sendReminderEmailToUsers(users, templates, mockMailer, state, []int{7, 14, 30}, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 0)
+}
+
+// emailTo matches e-mails sent to the user.
+func emailTo(user string) interface{} {
+	return mock.MatchedBy(func(email message.Email) bool {
+		return email.To == user
+	})
+}
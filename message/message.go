@@ -0,0 +1,12 @@
+// Package message holds the messages sent by buildpack-notify.
+// It lives outside of package main so that the mocks can use it.
+package message
+
+// Email is an e-mail to a single recipient.
+// HTML is sent as an alternative to the plain-text body when it is set.
+type Email struct {
+	To      string
+	Subject string
+	Text    []byte
+	HTML    []byte
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"net/mail"
+	"strings"
+)
+
+const (
+	// optOutLabel set to true on an app, its space or its org stops notices about the app.
+	optOutLabel = "buildpack-notify.cloud.gov/opt-out"
+	// contactAnnotation on an app, its space or its org has the e-mail addresses which get notices about the app
+	// instead of the users with roles in its space and org.
+	contactAnnotation = "buildpack-notify.cloud.gov/contact"
+)
+
+// lookupMetadata gets the value from the app's metadata, or else its space's, or else its org's. Setting it on the
+// app overrides its space and org, e.g. an app can be opted back in with opt-out=false in an opted-out space.
+func lookupMetadata(app App, get func(Metadata) string) string {
+	for _, metadata := range []Metadata{app.Metadata, app.Space.Metadata, app.Org.Metadata} {
+		if value := get(metadata); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// isOptedOut checks whether the app, its space or its org has opted out of notices.
+func isOptedOut(app App) bool {
+	return lookupMetadata(app, func(m Metadata) string { return m.Labels[optOutLabel] }) == "true"
+}
+
+// getContacts gets the comma-separated e-mail addresses in the contact annotation of the app, its space or its
+// org. Invalid addresses are dropped.
+func getContacts(app App) []string {
+	annotation := lookupMetadata(app, func(m Metadata) string { return m.Annotations[contactAnnotation] })
+	if annotation == "" {
+		return nil
+	}
+	var contacts []string
+	for _, contact := range strings.Split(annotation, ",") {
+		address, err := mail.ParseAddress(strings.TrimSpace(contact))
+		if err != nil {
+			log.Printf("Dropping contact %s of app %s guid %s because invalid e-mail address\n", contact, app.Name, app.GUID)
+			continue
+		}
+		contacts = append(contacts, address.Address)
+	}
+	return contacts
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsOptedOut(t *testing.T) {
+	optOut := func(value string) Metadata {
+		return Metadata{Labels: map[string]string{optOutLabel: value}}
+	}
+	testCases := []struct {
+		name     string
+		app      App
+		expected bool
+	}{
+		{"no labels", App{}, false},
+		{"app opted out", App{Metadata: optOut("true")}, true},
+		{"space opted out", App{Space: Space{Metadata: optOut("true")}}, true},
+		{"org opted out", App{Org: Organization{Metadata: optOut("true")}}, true},
+		{"app opted back in", App{Metadata: optOut("false"), Org: Organization{Metadata: optOut("true")}}, false},
+		{"other value", App{Metadata: optOut("yes")}, false},
+	}
+	for _, tc := range testCases {
+		if actual := isOptedOut(tc.app); actual != tc.expected {
+			t.Errorf("Test %s failed. Expected %v, found %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestGetContacts(t *testing.T) {
+	contact := func(value string) Metadata {
+		return Metadata{Annotations: map[string]string{contactAnnotation: value}}
+	}
+	testCases := []struct {
+		name     string
+		app      App
+		expected []string
+	}{
+		{"no annotations", App{}, nil},
+		{"app contact", App{Metadata: contact("team@agency.gov")}, []string{"team@agency.gov"}},
+		{"space contact", App{Space: Space{Metadata: contact("space@agency.gov")}}, []string{"space@agency.gov"}},
+		{
+			"app overrides org",
+			App{Metadata: contact("team@agency.gov"), Org: Organization{Metadata: contact("org@agency.gov")}},
+			[]string{"team@agency.gov"},
+		},
+		{
+			"several contacts",
+			App{Metadata: contact("team@agency.gov, Ops <ops@agency.gov>,not-an-address")},
+			[]string{"team@agency.gov", "ops@agency.gov"},
+		},
+	}
+	for _, tc := range testCases {
+		if actual := getContacts(tc.app); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("Test %s failed. Expected %v, found %v", tc.name, tc.expected, actual)
+		}
+	}
+}
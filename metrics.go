@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsNamespace = "buildpack_notify"
+	// lastSuccessMetric is read back from the metrics file so it is kept by one-shot runs which fail.
+	lastSuccessMetric = metricsNamespace + "_last_success_timestamp_seconds"
+)
+
+// apiLatencyBuckets are the upper bounds in seconds of the CF API request latency histogram.
+var apiLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// guidPattern matches the GUIDs in CF API paths, which are replaced so paths can be used as labels.
+var guidPattern = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// labelValueEscaper escapes label values for the Prometheus text format.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// appMetrics are the metrics of the process. Counters add up over the runs in service mode.
+var appMetrics = newMetrics()
+
+// metrics about runs, in the Prometheus text format.
+type metrics struct {
+	mu sync.Mutex
+
+	// Counters.
+	runs        map[string]float64
+	deliveries  map[[2]string]float64
+	apiRequests map[[3]string]float64
+	apiLatency  map[string]*histogram
+
+	// Gauges about the last run.
+	appsScanned         float64
+	appsByDecision      map[string]float64
+	outdatedByBuildpack map[string]float64
+	outdatedByOrg       map[string]float64
+	lastRunDuration     float64
+	lastRunTimestamp    float64
+	lastExitCode        float64
+	lastSuccess         float64
+}
+
+type histogram struct {
+	// counts has a count for each bucket, and a last one for all observations.
+	counts []float64
+	sum    float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		runs:                make(map[string]float64),
+		deliveries:          make(map[[2]string]float64),
+		apiRequests:         make(map[[3]string]float64),
+		apiLatency:          make(map[string]*histogram),
+		appsByDecision:      make(map[string]float64),
+		outdatedByBuildpack: make(map[string]float64),
+		outdatedByOrg:       make(map[string]float64),
+	}
+}
+
+// observeAPIRequest records a request to the CF API. The status is "error" when there was no response.
+func (m *metrics) observeAPIRequest(method, path, status string, duration time.Duration) {
+	endpoint := guidPattern.ReplaceAllString(path, ":guid")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiRequests[[3]string{method, endpoint, status}]++
+	h, found := m.apiLatency[endpoint]
+	if !found {
+		h = &histogram{counts: make([]float64, len(apiLatencyBuckets)+1)}
+		m.apiLatency[endpoint] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range apiLatencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(apiLatencyBuckets)]++
+	h.sum += seconds
+}
+
+// observeRun records the outcome of a run from its report.
+func (m *metrics) observeRun(report *runReport, exitCode int, finishedAt time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs[strconv.Itoa(exitCode)]++
+	m.appsScanned = float64(len(report.Apps))
+	m.appsByDecision = make(map[string]float64)
+	m.outdatedByBuildpack = make(map[string]float64)
+	m.outdatedByOrg = make(map[string]float64)
+	for _, app := range report.Apps {
+		m.appsByDecision[app.Decision]++
+		if app.Decision == decisionOutdated {
+			if len(app.OutdatedBuildpacks) > 0 {
+				for _, buildpack := range app.OutdatedBuildpacks {
+					m.outdatedByBuildpack[buildpack.BuildpackName]++
+				}
+			} else if app.Buildpack != nil {
+				m.outdatedByBuildpack[app.Buildpack.BuildpackName]++
+			}
+			if app.OrgName != "" {
+				m.outdatedByOrg[app.OrgName]++
+			}
+		}
+		for _, delivery := range app.Deliveries {
+			m.deliveries[[2]string{delivery.Kind, delivery.Outcome}]++
+		}
+	}
+	m.lastRunDuration = finishedAt.Sub(report.startedAt).Seconds()
+	m.lastRunTimestamp = float64(finishedAt.Unix())
+	m.lastExitCode = float64(exitCode)
+	if exitCode != exitFailure {
+		m.lastSuccess = float64(finishedAt.Unix())
+	}
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// writeFile writes the metrics for the node exporter's textfile collector. The file is replaced atomically.
+// If there has been no successful run, the time of the last success is kept from the old file.
+func (m *metrics) writeFile(path string) error {
+	m.mu.Lock()
+	if m.lastSuccess == 0 {
+		m.lastSuccess = readMetric(path, lastSuccessMetric)
+	}
+	m.mu.Unlock()
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := m.write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readMetric reads the value of an unlabelled metric from a metrics file, or 0 if it isn't there.
+func readMetric(path string, name string) float64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), name+" "); found {
+			v, _ := strconv.ParseFloat(value, 64)
+			return v
+		}
+	}
+	return 0
+}
+
+func (m *metrics) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	writeMetric(bw, "runs_total", "counter", "Runs by exit code.", labelled("exit_code", m.runs))
+	writeMetric(bw, "apps_scanned", "gauge", "Apps examined in the last run.", []sample{{value: m.appsScanned}})
+	writeMetric(bw, "apps", "gauge", "Apps by the decision made about them in the last run.", labelled("decision", m.appsByDecision))
+	writeMetric(bw, "apps_outdated_by_buildpack", "gauge", "Outdated apps by buildpack in the last run.", labelled("buildpack", m.outdatedByBuildpack))
+	writeMetric(bw, "apps_outdated_by_org", "gauge", "Outdated apps by org in the last run.", labelled("org", m.outdatedByOrg))
+
+	var deliveries []sample
+	for key, value := range m.deliveries {
+		deliveries = append(deliveries, sample{labels: [][2]string{{"kind", key[0]}, {"outcome", key[1]}}, value: value})
+	}
+	writeMetric(bw, "deliveries_total", "counter", "E-mails and webhook events attempted, by kind and outcome.", deliveries)
+
+	var requests []sample
+	for key, value := range m.apiRequests {
+		requests = append(requests, sample{labels: [][2]string{{"method", key[0]}, {"endpoint", key[1]}, {"status", key[2]}}, value: value})
+	}
+	writeMetric(bw, "cf_api_requests_total", "counter", "Requests to the CF API by method, endpoint and status.", requests)
+
+	endpoints := make([]string, 0, len(m.apiLatency))
+	for endpoint := range m.apiLatency {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	var latency []sample
+	for _, endpoint := range endpoints {
+		h := m.apiLatency[endpoint]
+		for i, bound := range apiLatencyBuckets {
+			latency = append(latency, sample{suffix: "_bucket", labels: [][2]string{{"endpoint", endpoint}, {"le", formatFloat(bound)}}, value: h.counts[i]})
+		}
+		all := h.counts[len(apiLatencyBuckets)]
+		latency = append(latency,
+			sample{suffix: "_bucket", labels: [][2]string{{"endpoint", endpoint}, {"le", "+Inf"}}, value: all},
+			sample{suffix: "_sum", labels: [][2]string{{"endpoint", endpoint}}, value: h.sum},
+			sample{suffix: "_count", labels: [][2]string{{"endpoint", endpoint}}, value: all},
+		)
+	}
+	writeMetric(bw, "cf_api_request_duration_seconds", "histogram", "Latency of requests to the CF API by endpoint.", latency)
+
+	if m.lastRunTimestamp != 0 {
+		writeMetric(bw, "last_run_duration_seconds", "gauge", "How long the last run took.", []sample{{value: m.lastRunDuration}})
+		writeMetric(bw, "last_run_timestamp_seconds", "gauge", "When the last run finished.", []sample{{value: m.lastRunTimestamp}})
+		writeMetric(bw, "last_run_exit_code", "gauge", "Exit code of the last run.", []sample{{value: m.lastExitCode}})
+	}
+	if m.lastSuccess != 0 {
+		writeMetric(bw, "last_success_timestamp_seconds", "gauge", "When the last run which saved its state finished.", []sample{{value: m.lastSuccess}})
+	}
+	return bw.Flush()
+}
+
+type sample struct {
+	suffix string
+	labels [][2]string
+	value  float64
+}
+
+func labelled(label string, values map[string]float64) []sample {
+	var samples []sample
+	for key, value := range values {
+		samples = append(samples, sample{labels: [][2]string{{label, key}}, value: value})
+	}
+	return samples
+}
+
+// writeMetric writes a metric in the Prometheus text format. Samples are sorted so the output is stable.
+func writeMetric(w io.Writer, name, metricType, help string, samples []sample) {
+	name = metricsNamespace + "_" + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	lines := make([]string, 0, len(samples))
+	for _, s := range samples {
+		var labels []string
+		for _, label := range s.labels {
+			labels = append(labels, label[0]+`="`+labelValueEscaper.Replace(label[1])+`"`)
+		}
+		line := name + s.suffix
+		if len(labels) > 0 {
+			line += "{" + strings.Join(labels, ",") + "}"
+		}
+		lines = append(lines, line+" "+formatFloat(s.value))
+	}
+	if metricType != "histogram" {
+		sort.Strings(lines)
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsTransport records the requests made to the CF API.
+type metricsTransport struct {
+	base    http.RoundTripper
+	metrics *metrics
+}
+
+// newMetricsTransport creates a transport for the CF API which records its requests. It does its own TLS config,
+// which the CF client can't do for wrapped transports.
+func newMetricsTransport(m *metrics, skipSSLValidation bool) *metricsTransport {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = &tls.Config{InsecureSkipVerify: skipSSLValidation}
+	return &metricsTransport{base: base, metrics: m}
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	t.metrics.observeAPIRequest(req.Method, req.URL.Path, status, time.Since(start))
+	return resp, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/droplets") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	client := &http.Client{Transport: newMetricsTransport(m, false)}
+	for _, path := range []string{"/v3/apps", "/v3/apps", "/v3/apps/6064d98a-95e6-400b-bc03-be65e6d59622/droplets"} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	report := newRunReport(false)
+	python := buildpackReleaseInfo{BuildpackName: "python_buildpack"}
+	report.addApp(App{GUID: "app1"}, decisionOutdated, &python)
+	report.addApp(App{GUID: "app2"}, decisionOutdated, &python)
+	report.addApp(App{GUID: "app3"}, decisionNotStarted, nil)
+	report.apps["app1"].OrgName = `org "one"`
+	report.addDelivery("app1", deliveryReport{Kind: deliveryNotification, Recipient: user1, Outcome: outcomeSent})
+	report.addDelivery("app2", deliveryReport{Kind: deliveryNotification, Recipient: user1, Outcome: outcomeFailed})
+	m.observeRun(report, exitPartialSuccess, time.Unix(1700000000, 0))
+
+	var out bytes.Buffer
+	if err := m.write(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`buildpack_notify_runs_total{exit_code="2"} 1`,
+		`buildpack_notify_apps_scanned 3`,
+		`buildpack_notify_apps{decision="outdated"} 2`,
+		`buildpack_notify_apps{decision="skipped_not_started"} 1`,
+		`buildpack_notify_apps_outdated_by_buildpack{buildpack="python_buildpack"} 2`,
+		`buildpack_notify_apps_outdated_by_org{org="org \"one\""} 1`,
+		`buildpack_notify_deliveries_total{kind="notification",outcome="failed"} 1`,
+		`buildpack_notify_deliveries_total{kind="notification",outcome="sent"} 1`,
+		`buildpack_notify_cf_api_requests_total{method="GET",endpoint="/v3/apps",status="200"} 2`,
+		`buildpack_notify_cf_api_requests_total{method="GET",endpoint="/v3/apps/:guid/droplets",status="404"} 1`,
+		`buildpack_notify_cf_api_request_duration_seconds_bucket{endpoint="/v3/apps",le="+Inf"} 2`,
+		`buildpack_notify_cf_api_request_duration_seconds_count{endpoint="/v3/apps"} 2`,
+		`buildpack_notify_last_run_exit_code 2`,
+		`buildpack_notify_last_success_timestamp_seconds 1.7e+09`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Expected metrics to have %s. Actual:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestMetricsFileKeepsLastSuccess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buildpack_notify.prom")
+	succeeded := newMetrics()
+	succeeded.observeRun(newRunReport(false), exitSuccess, time.Unix(1700000000, 0))
+	if err := succeeded.writeFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next one-shot run fails.
+	failed := newMetrics()
+	failed.observeRun(newRunReport(false), exitFailure, time.Unix(1700003600, 0))
+	if err := failed.writeFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "buildpack_notify_last_success_timestamp_seconds 1.7e+09\n") ||
+		!strings.Contains(string(data), "buildpack_notify_last_run_exit_code 1\n") {
+		t.Errorf("Expected the last success to be kept. Actual:\n%s", data)
+	}
+}
@@ -1,19 +1,22 @@
 package mocks
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	message "github.com/cloud-gov/buildpack-notify/message"
+	mock "github.com/stretchr/testify/mock"
+)
 
 // Mailer is an autogenerated mock type for the Mailer type
 type Mailer struct {
 	mock.Mock
 }
 
-// SendEmail provides a mock function with given fields: emailAddress, subject, body
-func (_m *Mailer) SendEmail(emailAddress string, subject string, body []byte) error {
-	ret := _m.Called(emailAddress, subject, body)
+// SendEmail provides a mock function with given fields: email
+func (_m *Mailer) SendEmail(email message.Email) error {
+	ret := _m.Called(email)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string, []byte) error); ok {
-		r0 = rf(emailAddress, subject, body)
+	if rf, ok := ret.Get(0).(func(message.Email) error); ok {
+		r0 = rf(email)
 	} else {
 		r0 = ret.Error(0)
 	}
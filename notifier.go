@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// slackChannelAnnotation is the space or org annotation which maps the space to a chat channel.
+// An annotation on the space takes precedence over one on its org.
+const slackChannelAnnotation = "buildpack-notify.cloud.gov/slack-channel"
+
+// Notifier is a interface that any chat notifier should implement.
+type Notifier interface {
+	// NotifySpace tells the space's channel about the outdated apps in the space.
+	NotifySpace(summary spaceSummary) error
+	// NotifyRun tells platform operators what happened in the run.
+	NotifyRun(summary runSummary) error
+}
+
+// spaceSummary is the outdated apps in one space.
+type spaceSummary struct {
+	Channel   string
+	OrgName   string
+	SpaceName string
+	Apps      []notifyApp
+}
+
+// runSummary is what happened in a run.
+type runSummary struct {
+	OutdatedApps      int
+	NewlyOutdatedApps int
+	Spaces            int
+	NotificationsSent int
+	RemindersSent     int
+	EscalationsSent   int
+	Buildpacks        []buildpackReleaseInfo
+}
+
+// InitSlackNotifier creates a new notifier which posts to a Slack-compatible incoming webhook.
+// The run summary is posted to channel, or to the webhook's own channel if it is empty.
+func InitSlackNotifier(config Config) Notifier {
+	return &slackNotifier{
+		webhookURL: config.SlackWebhookURL,
+		channel:    config.SlackChannel,
+		username:   config.SlackUsername,
+		iconURL:    config.SlackIconURL,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type slackNotifier struct {
+	webhookURL string
+	channel    string
+	username   string
+	iconURL    string
+	client     *http.Client
+}
+
+// slackMessage is the payload of a Slack incoming webhook.
+type slackMessage struct {
+	Channel  string `json:"channel,omitempty"`
+	Username string `json:"username,omitempty"`
+	IconURL  string `json:"icon_url,omitempty"`
+	Text     string `json:"text"`
+}
+
+func (s *slackNotifier) NotifySpace(summary spaceSummary) error {
+	var text strings.Builder
+	fmt.Fprintf(&text, "%d application(s) in %s / %s need to be restaged to pick up buildpack updates:\n",
+		len(summary.Apps), escapeSlackText(summary.OrgName), escapeSlackText(summary.SpaceName))
+	for _, app := range summary.Apps {
+		var buildpacks []string
+		for _, buildpack := range app.OutdatedBuildpacks {
+			buildpacks = append(buildpacks, formatSlackBuildpack(buildpack))
+		}
+		fmt.Fprintf(&text, "• %s uses %s\n", escapeSlackText(app.Name), strings.Join(buildpacks, ", "))
+	}
+	return s.post(slackMessage{Channel: summary.Channel, Text: text.String()})
+}
+
+func (s *slackNotifier) NotifyRun(summary runSummary) error {
+	var text strings.Builder
+	fmt.Fprintf(&text, "buildpack-notify found %d outdated application(s), %d of them newly outdated in %d space(s).\n",
+		summary.OutdatedApps, summary.NewlyOutdatedApps, summary.Spaces)
+	fmt.Fprintf(&text, "Sent %d notification(s), %d reminder(s) and %d escalation(s).\n",
+		summary.NotificationsSent, summary.RemindersSent, summary.EscalationsSent)
+	if len(summary.Buildpacks) > 0 {
+		text.WriteString("Updated buildpacks:\n")
+		for _, buildpack := range summary.Buildpacks {
+			fmt.Fprintf(&text, "• %s\n", formatSlackBuildpack(buildpack))
+		}
+	}
+	return s.post(slackMessage{Channel: s.channel, Text: text.String()})
+}
+
+func (s *slackNotifier) post(msg slackMessage) error {
+	msg.Username = s.username
+	msg.IconURL = s.iconURL
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// formatSlackBuildpack formats the buildpack release, linking to the release notes if there are any.
+func formatSlackBuildpack(buildpack buildpackReleaseInfo) string {
+	name := escapeSlackText(buildpack.BuildpackName + " " + buildpack.BuildpackVersion)
+	if buildpack.BuildpackURL == "" {
+		return name
+	}
+	return fmt.Sprintf("<%s|%s>", buildpack.BuildpackURL, name)
+}
+
+// escapeSlackText escapes the characters Slack uses for markup.
+func escapeSlackText(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// filterForNewlyOutdatedApps gets the apps which are outdated by buildpack releases that no one had been notified
+// about before this run. Chat summaries are only posted once per release, so retries and reminders don't repeat them.
+func filterForNewlyOutdatedApps(apps []notifyApp, notifiedReleases map[string]bool) []notifyApp {
+	var newApps []notifyApp
+	for _, app := range apps {
+		if !notifiedReleases[releaseKey(app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)] {
+			newApps = append(newApps, app)
+		}
+	}
+	return newApps
+}
+
+// findSpaceSummaries groups the apps by space and maps each space to the channel in its annotations, or else its
+// org's. The spaces and orgs come with the app listing, so no further requests are needed. Each app is listed once
+// with all its outdated buildpacks. Spaces without a channel are left out.
+func findSpaceSummaries(apps []notifyApp) []spaceSummary {
+	apps = groupAppsByGUID(apps)
+	summaries := make(map[string]*spaceSummary)
+	var spaceGUIDs []string
+	for _, app := range apps {
+		if summary, found := summaries[app.Space.GUID]; found {
+			summary.Apps = append(summary.Apps, app)
+			continue
+		}
+		channel := app.Space.Metadata.Annotations[slackChannelAnnotation]
+		if channel == "" {
+			channel = app.Org.Metadata.Annotations[slackChannelAnnotation]
+		}
+		summaries[app.Space.GUID] = &spaceSummary{
+			Channel:   channel,
+			OrgName:   app.Org.Name,
+			SpaceName: app.Space.Name,
+			Apps:      []notifyApp{app},
+		}
+		spaceGUIDs = append(spaceGUIDs, app.Space.GUID)
+	}
+	sort.Strings(spaceGUIDs)
+
+	var channelSummaries []spaceSummary
+	for _, spaceGUID := range spaceGUIDs {
+		if summary := summaries[spaceGUID]; summary.Channel != "" {
+			channelSummaries = append(channelSummaries, *summary)
+		}
+	}
+	return channelSummaries
+}
+
+// countSpacesOfApps counts the spaces the apps are in.
+func countSpacesOfApps(apps []notifyApp) int {
+	spaces := make(map[string]bool)
+	for _, app := range apps {
+		spaces[app.Space.GUID] = true
+	}
+	return len(spaces)
+}
+
+// sendSpaceSummaries posts the summary of each space to its channel. It returns an error for each summary
+// which couldn't be posted.
+func sendSpaceSummaries(summaries []spaceSummary, notifier Notifier, dryRun bool) error {
+	var errs []error
+	for _, summary := range summaries {
+		if !dryRun {
+			if err := notifier.NotifySpace(summary); err != nil {
+				errs = append(errs, fmt.Errorf("unable to post summary of space %s to %s: %s", summary.SpaceName, summary.Channel, err))
+				continue
+			}
+		}
+		fmt.Printf("Posted summary of space %s to %s\n", summary.SpaceName, summary.Channel)
+	}
+	return errors.Join(errs...)
+}
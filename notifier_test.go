@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestSpaceApp(name, spaceGUID, spaceName, orgGUID string) notifyApp {
+	buildpack := buildpackReleaseInfo{BuildpackName: "python_buildpack", BuildpackVersion: "v1.7.43",
+		BuildpackURL: "https://github.com/cloudfoundry/python-buildpack/releases/tag/v1.7.43"}
+	return notifyApp{
+		App: App{
+			GUID:  name + "-guid",
+			Name:  name,
+			Space: Space{GUID: spaceGUID, Name: spaceName},
+			Org:   Organization{GUID: orgGUID, Name: "sandbox"},
+		},
+		Buildpack:          buildpack,
+		OutdatedBuildpacks: []buildpackReleaseInfo{buildpack},
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	var messages []slackMessage
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg slackMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Fatalf("Unable to decode webhook payload. Error: %s", err.Error())
+		}
+		messages = append(messages, msg)
+	}))
+	defer ts.Close()
+	notifier := InitSlackNotifier(Config{SlackWebhookURL: ts.URL, SlackChannel: "#cg-platform", SlackUsername: "buildpack-notify"})
+
+	app := newTestSpaceApp("<my-app>", "space1", "dev", "org1")
+	if err := notifier.NotifySpace(spaceSummary{"#team", "sandbox", "dev", []notifyApp{app}}); err != nil {
+		t.Fatalf("Unable to notify space. Error: %s", err.Error())
+	}
+	if err := notifier.NotifyRun(runSummary{OutdatedApps: 1, NewlyOutdatedApps: 1, Spaces: 1, NotificationsSent: 2,
+		Buildpacks: []buildpackReleaseInfo{app.Buildpack}}); err != nil {
+		t.Fatalf("Unable to notify run. Error: %s", err.Error())
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages to be posted, found %d", len(messages))
+	}
+	if messages[0].Channel != "#team" || messages[0].Username != "buildpack-notify" {
+		t.Errorf("Expected space summary to be posted to #team, found %+v", messages[0])
+	}
+	if !strings.Contains(messages[0].Text, "&lt;my-app&gt; uses <https://github.com/cloudfoundry/python-buildpack/releases/tag/v1.7.43|python_buildpack v1.7.43>") {
+		t.Errorf("Expected the app and a link to the release notes in the space summary, found %s", messages[0].Text)
+	}
+	if messages[1].Channel != "#cg-platform" || !strings.Contains(messages[1].Text, "Sent 2 notification(s)") {
+		t.Errorf("Expected run summary to be posted to #cg-platform, found %+v", messages[1])
+	}
+
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	if err := notifier.NotifyRun(runSummary{}); err == nil {
+		t.Error("Expected an error when the webhook fails")
+	}
+}
+
+func TestFindSpaceSummaries(t *testing.T) {
+	space1 := Space{GUID: "space1", Name: "dev", Metadata: Metadata{Annotations: map[string]string{slackChannelAnnotation: "#space-team"}}}
+	org1 := Organization{GUID: "org1", Name: "sandbox", Metadata: Metadata{Annotations: map[string]string{slackChannelAnnotation: "#org-team"}}}
+	apps := []notifyApp{
+		newTestSpaceApp("app1", "space1", "dev", "org1"),
+		newTestSpaceApp("app2", "space1", "dev", "org1"),
+		newTestSpaceApp("app3", "space2", "staging", "org1"),
+		newTestSpaceApp("app4", "space3", "prod", "org2"),
+	}
+	for i := range apps[:3] {
+		apps[i].Org = org1
+	}
+	apps[0].Space, apps[1].Space = space1, space1
+
+	summaries := findSpaceSummaries(apps)
+	if len(summaries) != 2 {
+		t.Fatalf("Expected summaries for the 2 spaces with a channel, found %+v", summaries)
+	}
+	if summaries[0].Channel != "#space-team" || len(summaries[0].Apps) != 2 {
+		t.Errorf("Expected both apps in space1 to go to the space's channel, found %+v", summaries[0])
+	}
+	if summaries[1].Channel != "#org-team" || summaries[1].SpaceName != "staging" {
+		t.Errorf("Expected space2 to fall back to the org's channel, found %+v", summaries[1])
+	}
+}
+
+func TestFilterForNewlyOutdatedApps(t *testing.T) {
+	app := notifyApp{Buildpack: buildpackReleaseInfo{BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}}
+	if apps := filterForNewlyOutdatedApps([]notifyApp{app}, map[string]bool{}); len(apps) != 1 {
+		t.Errorf("Expected app outdated by a new release to be kept, found %+v", apps)
+	}
+	notifiedReleases := map[string]bool{releaseKey("python-guid", "2016-06-08T16:41:45Z"): true}
+	if apps := filterForNewlyOutdatedApps([]notifyApp{app}, notifiedReleases); len(apps) != 0 {
+		t.Errorf("Expected app outdated by an already notified release to be dropped, found %+v", apps)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "sync"
+
+// forEachConcurrently calls fn for each index from 0 to n-1, with at most workers calls at a time, and returns once
+// they are all done. To keep results in a stable order, fn should store the result for index i at index i.
+func forEachConcurrently(n int, workers int, fn func(i int)) {
+	workers = max(1, min(workers, n))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := range n {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
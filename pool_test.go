@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachConcurrently(t *testing.T) {
+	testCases := []struct {
+		name    string
+		n       int
+		workers int
+	}{
+		{"more items than workers", 20, 4},
+		{"more workers than items", 3, 10},
+		{"no items", 0, 4},
+		{"invalid workers", 5, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var running, maxRunning int32
+			results := make([]int, tc.n)
+			forEachConcurrently(tc.n, tc.workers, func(i int) {
+				now := atomic.AddInt32(&running, 1)
+				for {
+					seen := atomic.LoadInt32(&maxRunning)
+					if now <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, now) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				results[i] = i * i
+				atomic.AddInt32(&running, -1)
+			})
+			for i, result := range results {
+				if result != i*i {
+					t.Errorf("Test %s failed. Expected result %d at %d, found %d", tc.name, i*i, i, result)
+				}
+			}
+			if limit := int32(max(tc.workers, 1)); maxRunning > limit {
+				t.Errorf("Test %s failed. Expected at most %d calls at a time, found %d", tc.name, limit, maxRunning)
+			}
+		})
+	}
+}
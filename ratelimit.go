@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitRetries is how many times a rate-limited request is retried.
+	rateLimitRetries = 5
+	// rateLimitDefaultWait is how long to wait after the first rate-limited response which doesn't say how long
+	// to wait. It doubles for each retry.
+	rateLimitDefaultWait = time.Second
+	// rateLimitMaxWait caps the wait, e.g. if the API asks to wait until the end of a long rate-limit window.
+	rateLimitMaxWait = 5 * time.Minute
+)
+
+// rateLimitTransport retries requests which the CF API rejects with 429 Too Many Requests. When one request is
+// rate limited, all requests wait, so concurrent lookups don't keep hitting the limit.
+type rateLimitTransport struct {
+	base http.RoundTripper
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	wait := rateLimitDefaultWait
+	for attempt := 0; ; attempt++ {
+		t.mu.Lock()
+		pause := time.Until(t.pausedUntil)
+		t.mu.Unlock()
+		if pause > 0 {
+			select {
+			case <-time.After(pause):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= rateLimitRetries {
+			return resp, err
+		}
+		// The body can only be sent again if it can be recreated.
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+		resp.Body.Close()
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		pause = min(retryAfter(resp, time.Now(), wait), rateLimitMaxWait)
+		wait *= 2
+		log.Printf("CF API rate limit reached, retrying %s %s in %s\n", req.Method, req.URL.Path, pause)
+		t.mu.Lock()
+		if until := time.Now().Add(pause); until.After(t.pausedUntil) {
+			t.pausedUntil = until
+		}
+		t.mu.Unlock()
+	}
+}
+
+// retryAfter gets how long a rate-limited response says to wait, from Retry-After in seconds or as a date, or from
+// X-RateLimit-Reset, the time the CF API's rate limit resets in seconds since the epoch.
+func retryAfter(resp *http.Response, now time.Time, defaultWait time.Duration) time.Duration {
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return max(date.Sub(now), 0)
+		}
+	}
+	if value := resp.Header.Get("X-RateLimit-Reset"); value != "" {
+		if reset, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return max(time.Unix(reset, 0).Sub(now), 0)
+		}
+	}
+	return defaultWait
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitTransportRetries(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &rateLimitTransport{base: http.DefaultTransport}}
+	resp, err := client.Post(ts.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || attempts != 3 {
+		t.Errorf("Expected the request to be retried until it succeeded. Status %d after %d attempts", resp.StatusCode, attempts)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 10, 10, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		header   string
+		value    string
+		expected time.Duration
+	}{
+		{"seconds", "Retry-After", "3", 3 * time.Second},
+		{"date", "Retry-After", now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{"rate limit reset", "X-RateLimit-Reset", strconv.FormatInt(now.Add(10*time.Second).Unix(), 10), 10 * time.Second},
+		{"reset in the past", "X-RateLimit-Reset", strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), 0},
+		{"no header", "", "", 2 * time.Second},
+		{"invalid header", "Retry-After", "soon", 2 * time.Second},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tc.header != "" {
+				resp.Header.Set(tc.header, tc.value)
+			}
+			if wait := retryAfter(resp, now, 2*time.Second); wait != tc.expected {
+				t.Errorf("Test %s failed. Expected %s, found %s", tc.name, tc.expected, wait)
+			}
+		})
+	}
+}
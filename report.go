@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Decisions made about the apps examined in a run.
+const (
+	decisionNotStarted           = "skipped_not_started"
+	decisionOptedOut             = "skipped_opted_out"
+	decisionNoDroplet            = "skipped_no_droplet"
+	decisionUnsupportedBuildpack = "skipped_unsupported_buildpack"
+	decisionUpToDate             = "skipped_up_to_date"
+	decisionOutdated             = "outdated"
+	decisionError                = "error"
+)
+
+// Kinds and outcomes of deliveries in the run report.
+const (
+	deliveryNotification = "notification"
+	deliveryReminder     = "reminder"
+	deliveryEscalation   = "escalation"
+	deliveryWebhook      = "webhook"
+
+	outcomeSent   = "sent"
+	outcomeFailed = "failed"
+	// outcomeDryRun is a delivery which would have been made if it wasn't a dry run or a preview.
+	outcomeDryRun = "dry_run"
+)
+
+// runReport is the machine-readable report of a run which is written to REPORT_FILE.
+type runReport struct {
+	StartedAt   string `json:"started_at"`
+	FinishedAt  string `json:"finished_at"`
+	ToolVersion string `json:"tool_version"`
+	DryRun      bool   `json:"dry_run"`
+	ExitCode    int    `json:"exit_code"`
+	// Error is the error which stopped the run, if any.
+	Error  string       `json:"error,omitempty"`
+	Errors []string     `json:"errors"`
+	Apps   []*appReport `json:"apps"`
+
+	startedAt time.Time
+	apps      map[string]*appReport
+}
+
+// appReport is what happened to an app in the run.
+type appReport struct {
+	GUID      string                `json:"guid"`
+	Name      string                `json:"name"`
+	OrgName   string                `json:"org_name,omitempty"`
+	SpaceName string                `json:"space_name,omitempty"`
+	Decision  string                `json:"decision"`
+	Buildpack *buildpackReleaseInfo `json:"buildpack,omitempty"`
+	// OutdatedBuildpacks are all the buildpacks which made the app outdated, the first of which is Buildpack.
+	OutdatedBuildpacks []buildpackReleaseInfo `json:"outdated_buildpacks,omitempty"`
+	SnoozedUntil       string                 `json:"snoozed_until,omitempty"`
+	Error              string                 `json:"error,omitempty"`
+	Deliveries         []deliveryReport       `json:"deliveries,omitempty"`
+}
+
+// deliveryReport is the outcome of telling a recipient about an app.
+type deliveryReport struct {
+	Kind      string `json:"kind"`
+	Recipient string `json:"recipient"`
+	Outcome   string `json:"outcome"`
+	Error     string `json:"error,omitempty"`
+}
+
+// newRunReport starts the report of a run.
+func newRunReport(dryRun bool) *runReport {
+	now := time.Now()
+	return &runReport{
+		StartedAt:   now.UTC().Format(time.RFC3339),
+		ToolVersion: version,
+		DryRun:      dryRun,
+		Errors:      []string{},
+		Apps:        []*appReport{},
+		startedAt:   now,
+		apps:        make(map[string]*appReport),
+	}
+}
+
+// addApp records the decision made about an app. It does nothing on a nil report.
+func (r *runReport) addApp(app App, decision string, buildpack *buildpackReleaseInfo) {
+	if r == nil {
+		return
+	}
+	report := &appReport{
+		GUID:      app.GUID,
+		Name:      app.Name,
+		OrgName:   app.Org.Name,
+		SpaceName: app.Space.Name,
+		Decision:  decision,
+		Buildpack: buildpack,
+	}
+	r.apps[app.GUID] = report
+	r.Apps = append(r.Apps, report)
+}
+
+// addSnoozes records until when reminders about the snoozed apps are snoozed.
+func (r *runReport) addSnoozes(apps []notifyApp) {
+	for _, app := range apps {
+		if report, found := r.apps[app.GUID]; found && app.SnoozedUntil != "" {
+			report.SnoozedUntil = app.SnoozedUntil
+		}
+	}
+}
+
+// addOutdatedApp records that the app is outdated by the buildpacks. It does nothing on a nil report.
+func (r *runReport) addOutdatedApp(app App, buildpacks []buildpackReleaseInfo) {
+	if r == nil {
+		return
+	}
+	r.addApp(app, decisionOutdated, &buildpacks[0])
+	r.apps[app.GUID].OutdatedBuildpacks = buildpacks
+}
+
+// addDeliveries records the outcomes of the attempts in this run to tell recipients about apps.
+func (r *runReport) addDeliveries(kind string, records map[string]notificationRecord) {
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		record := records[key]
+		attemptedAt, err := time.Parse(time.RFC3339, record.LastAttemptAt)
+		if err != nil || attemptedAt.Before(r.startedAt.Truncate(time.Second)) {
+			continue
+		}
+		outcome := outcomeSent
+		if record.LastError != "" {
+			outcome = outcomeFailed
+		} else if r.DryRun {
+			// E-mails are only written to files in preview mode.
+			outcome = outcomeDryRun
+		}
+		r.addDelivery(record.AppGUID, deliveryReport{kind, record.Recipient, outcome, record.LastError})
+	}
+}
+
+// addDryRunNotifications records the notifications which would have been sent.
+func (r *runReport) addDryRunNotifications(owners map[string][]notifyApp, state *savedState) {
+	notifiedApps := state.notifiedApps()
+	for _, user := range sortedRecipients(owners) {
+		for _, app := range filterForAppsToNotify(user, owners[user], state, notifiedApps) {
+			r.addDelivery(app.GUID, deliveryReport{Kind: deliveryNotification, Recipient: user, Outcome: outcomeDryRun})
+		}
+	}
+}
+
+// addDryRunReminders records the reminders which would have been sent.
+func (r *runReport) addDryRunReminders(owners map[string][]notifyApp, state *savedState, reminderDays []int) {
+	now := time.Now()
+	firstNotified := state.firstNotifiedTimes()
+	for _, user := range sortedRecipients(owners) {
+		apps, _ := filterForDueReminders(user, owners[user], state, reminderDays, now, firstNotified)
+		for _, app := range apps {
+			r.addDelivery(app.GUID, deliveryReport{Kind: deliveryReminder, Recipient: user, Outcome: outcomeDryRun})
+		}
+	}
+}
+
+// addDryRunEscalations records the escalations which would have been sent.
+func (r *runReport) addDryRunEscalations(managers map[string][]notifyApp, state *savedState) {
+	escalatedApps := state.escalatedApps()
+	for _, user := range sortedRecipients(managers) {
+		if !isEscalationDue(user, managers[user], state, escalatedApps) {
+			continue
+		}
+		for _, app := range managers[user] {
+			r.addDelivery(app.GUID, deliveryReport{Kind: deliveryEscalation, Recipient: user, Outcome: outcomeDryRun})
+		}
+	}
+}
+
+// addDryRunWebhookEvents records the webhook events which would have been delivered.
+func (r *runReport) addDryRunWebhookEvents(apps []notifyApp, webhookURL string, state *savedState) {
+	for _, app := range apps {
+		if !state.isWebhookDelivered(webhookURL, app) {
+			r.addDelivery(app.GUID, deliveryReport{Kind: deliveryWebhook, Recipient: webhookURL, Outcome: outcomeDryRun})
+		}
+	}
+}
+
+func (r *runReport) addDelivery(appGUID string, delivery deliveryReport) {
+	if app, found := r.apps[appGUID]; found {
+		app.Deliveries = append(app.Deliveries, delivery)
+	}
+}
+
+// finish records how the run ended. Errors about single apps are also added to the apps.
+func (r *runReport) finish(result *runResult, runErr error, exitCode int) {
+	r.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	r.ExitCode = exitCode
+	if runErr != nil {
+		r.Error = runErr.Error()
+	}
+	for _, err := range result.Errors {
+		r.Errors = append(r.Errors, err.Error())
+		var appErr *appError
+		if errors.As(err, &appErr) {
+			if app, found := r.apps[appErr.AppGUID]; found {
+				app.Error = appErr.Error()
+			}
+		}
+	}
+}
+
+// write writes the report as JSON. The file is replaced atomically so readers never see a partial report.
+func (r *runReport) write(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
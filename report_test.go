@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunReport(t *testing.T) {
+	report := newRunReport(false)
+	pythonBuildpack := buildpackReleaseInfo{BuildpackName: "python_buildpack", BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}
+	report.addApp(App{GUID: "app1", Name: "outdated"}, decisionOutdated, &pythonBuildpack)
+	report.addApp(App{GUID: "app2", Name: "stopped"}, decisionNotStarted, nil)
+	report.addApp(App{GUID: "app3", Name: "broken"}, decisionError, nil)
+
+	state := newSavedState()
+	app := notifyApp{App: App{GUID: "app1"}, Buildpack: pythonBuildpack}
+	state.recordNotification(user1, app, nil)
+	state.recordNotification(user2, app, errors.New("mailbox full"))
+	// Attempts from earlier runs are left out of the report.
+	state.Notifications[notificationKey("old@example.com", "app1", "python-guid", "2016-06-08T16:41:45Z")] = notificationRecord{
+		Recipient: "old@example.com", AppGUID: "app1", LastAttemptAt: "2016-01-01T00:00:00Z", SentAt: "2016-01-01T00:00:00Z",
+	}
+	report.addDeliveries(deliveryNotification, state.Notifications)
+
+	result := &runResult{}
+	result.addDiscoveryError(&appError{"app3", "broken", "check", errors.New("droplet lookup failed")})
+	report.finish(result, nil, result.exitCode())
+
+	if report.ExitCode != exitPartialSuccess || len(report.Errors) != 1 || report.FinishedAt == "" {
+		t.Errorf("Expected the run to be finished with a partial success. Actual %+v", report)
+	}
+	if len(report.Apps) != 3 {
+		t.Fatalf("Expected 3 apps in the report. Actual %+v", report.Apps)
+	}
+	deliveries := report.Apps[0].Deliveries
+	expectedDeliveries := []deliveryReport{
+		{deliveryNotification, user1, outcomeSent, ""},
+		{deliveryNotification, user2, outcomeFailed, "mailbox full"},
+	}
+	if len(deliveries) != len(expectedDeliveries) {
+		t.Fatalf("Expected deliveries %+v. Actual %+v", expectedDeliveries, deliveries)
+	}
+	for i, delivery := range deliveries {
+		if delivery != expectedDeliveries[i] {
+			t.Errorf("Expected delivery %+v. Actual %+v", expectedDeliveries[i], delivery)
+		}
+	}
+	if report.Apps[1].Decision != decisionNotStarted || len(report.Apps[1].Deliveries) != 0 {
+		t.Errorf("Unexpected report for stopped app %+v", report.Apps[1])
+	}
+	if report.Apps[2].Error == "" {
+		t.Errorf("Expected the error to be added to the broken app. Actual %+v", report.Apps[2])
+	}
+}
+
+func TestRunReportDryRun(t *testing.T) {
+	report := newRunReport(true)
+	pythonBuildpack := buildpackReleaseInfo{BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}
+	report.addApp(App{GUID: "app1"}, decisionOutdated, &pythonBuildpack)
+	app := notifyApp{App: App{GUID: "app1"}, Buildpack: pythonBuildpack}
+	state := newSavedState()
+	state.recordNotification(user1, app, nil)
+	state.recordNotification(user2, app, errors.New("mailbox full"))
+
+	report.addDryRunNotifications(map[string][]notifyApp{user1: {app}, user2: {app}}, state)
+	expected := []deliveryReport{{Kind: deliveryNotification, Recipient: user2, Outcome: outcomeDryRun}}
+	if deliveries := report.Apps[0].Deliveries; len(deliveries) != 1 || deliveries[0] != expected[0] {
+		t.Errorf("Expected only the notification which would be retried. Actual %+v", deliveries)
+	}
+}
+
+func TestRunReportDryRunOtherDeliveries(t *testing.T) {
+	report := newRunReport(true)
+	pythonBuildpack := buildpackReleaseInfo{BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}
+	report.addApp(App{GUID: "app1"}, decisionOutdated, &pythonBuildpack)
+	app := notifyApp{App: App{GUID: "app1"}, Buildpack: pythonBuildpack}
+	state := newSavedState()
+	state.recordNotification(user1, app, nil)
+	record := state.Notifications[notificationKey(user1, "app1", "python-guid", "2016-06-08T16:41:45Z")]
+	record.SentAt = time.Now().AddDate(0, 0, -10).UTC().Format(time.RFC3339)
+	state.Notifications[notificationKey(user1, "app1", "python-guid", "2016-06-08T16:41:45Z")] = record
+	state.recordWebhook("https://example.com/hook", app, nil)
+
+	report.addDryRunReminders(map[string][]notifyApp{user1: {app}}, state, []int{7})
+	report.addDryRunEscalations(map[string][]notifyApp{user2: {app}}, state)
+	report.addDryRunWebhookEvents([]notifyApp{app}, "https://example.com/hook", state)
+	report.addDryRunWebhookEvents([]notifyApp{app}, "https://example.com/other-hook", state)
+	expected := []deliveryReport{
+		{Kind: deliveryReminder, Recipient: user1, Outcome: outcomeDryRun},
+		{Kind: deliveryEscalation, Recipient: user2, Outcome: outcomeDryRun},
+		{Kind: deliveryWebhook, Recipient: "https://example.com/other-hook", Outcome: outcomeDryRun},
+	}
+	if deliveries := report.Apps[0].Deliveries; !reflect.DeepEqual(deliveries, expected) {
+		t.Errorf("Expected the reminder, escalation and webhook event which would be made. Actual %+v", deliveries)
+	}
+}
+
+func TestRunReportWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	report := newRunReport(false)
+	report.addApp(App{GUID: "app1", Name: "my-app"}, decisionUpToDate, nil)
+	report.finish(&runResult{}, errors.New("error saving state"), exitFailure)
+	if err := report.write(path); err != nil {
+		t.Fatalf("Unable to write report. Error: %s", err.Error())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read report. Error: %s", err.Error())
+	}
+	var written struct {
+		ExitCode int    `json:"exit_code"`
+		Error    string `json:"error"`
+		Apps     []struct {
+			GUID     string `json:"guid"`
+			Decision string `json:"decision"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatalf("Unable to decode report. Error: %s", err.Error())
+	}
+	if written.ExitCode != exitFailure || written.Error != "error saving state" || len(written.Apps) != 1 || written.Apps[0].Decision != decisionUpToDate {
+		t.Errorf("Unexpected report %s", data)
+	}
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 0 {
+		t.Errorf("Expected no temporary files to be left. Found %v", matches)
+	}
+}
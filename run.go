@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Exit codes of a run.
+const (
+	// exitSuccess means everything was done and the state was saved.
+	exitSuccess = 0
+	// exitFailure means the run stopped early or the state couldn't be saved.
+	exitFailure = 1
+	// exitPartialSuccess means the state was saved, but some apps or recipients had errors.
+	// They will be retried on the next run.
+	exitPartialSuccess = 2
+)
+
+// appError is an error about a single app, which is left out of the rest of the run.
+type appError struct {
+	AppGUID string
+	AppName string
+	// Action is what couldn't be done with the app, e.g. "check".
+	Action string
+	Err    error
+}
+
+func (e *appError) Error() string {
+	return fmt.Sprintf("unable to %s app %s App GUID %s: %s", e.Action, e.AppName, e.AppGUID, e.Err)
+}
+
+func (e *appError) Unwrap() error {
+	return e.Err
+}
+
+// runResult collects the errors of a run which only affected some apps or recipients.
+// The run carries on without them.
+type runResult struct {
+	Errors []error
+	// Incomplete is set when outdated apps may have been missed. The buildpack updates which were found in the run
+	// are then not recorded as handled, so that they are checked again on the next run.
+	Incomplete bool
+	// Report is what happened in the run.
+	Report *runReport
+}
+
+// addError records the errors, which may have been joined with errors.Join.
+func (r *runResult) addError(err error) {
+	if err == nil {
+		return
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		r.Errors = append(r.Errors, joined.Unwrap()...)
+		return
+	}
+	r.Errors = append(r.Errors, err)
+}
+
+// addDiscoveryError records errors finding outdated apps or their owners, which means apps may have been missed.
+func (r *runResult) addDiscoveryError(err error) {
+	if err == nil {
+		return
+	}
+	r.addError(err)
+	r.Incomplete = true
+}
+
+// prepareStateForCommit decides what of the state is safe to save. The notification history is always kept so
+// that nobody is sent the same e-mail twice. When apps may have been missed, the buildpack records go back to
+// how they were before the run so the buildpack updates are checked again.
+func (r *runResult) prepareStateForCommit(state *savedState, previousBuildpacks map[string]buildpackRecord) {
+	if !r.Incomplete {
+		return
+	}
+	log.Println("Some apps could not be checked. Buildpack updates will be checked again on the next run.")
+	state.Buildpacks = previousBuildpacks
+}
+
+// exitCode gets the exit code of a run which saved its state.
+func (r *runResult) exitCode() int {
+	if len(r.Errors) > 0 {
+		return exitPartialSuccess
+	}
+	return exitSuccess
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cloud-gov/buildpack-notify/message"
+	"github.com/cloud-gov/buildpack-notify/mocks"
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRunResult(t *testing.T) {
+	testCases := []struct {
+		name               string
+		errs               []error
+		discoveryErrs      []error
+		expectedErrors     int
+		expectedIncomplete bool
+		expectedExitCode   int
+	}{
+		{"no errors", []error{nil}, []error{nil}, 0, false, exitSuccess},
+		{"send errors", []error{errors.Join(errors.New("user1"), errors.New("user2"))}, nil, 2, false, exitPartialSuccess},
+		{"discovery errors", nil, []error{errors.New("app1")}, 1, true, exitPartialSuccess},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := &runResult{}
+			for _, err := range tc.errs {
+				result.addError(err)
+			}
+			for _, err := range tc.discoveryErrs {
+				result.addDiscoveryError(err)
+			}
+			if len(result.Errors) != tc.expectedErrors {
+				t.Errorf("Test %s failed. Expected %d errors, found %+v", tc.name, tc.expectedErrors, result.Errors)
+			}
+			if result.Incomplete != tc.expectedIncomplete {
+				t.Errorf("Test %s failed. Expected incomplete to be %v", tc.name, tc.expectedIncomplete)
+			}
+			if code := result.exitCode(); code != tc.expectedExitCode {
+				t.Errorf("Test %s failed. Expected exit code %d, found %d", tc.name, tc.expectedExitCode, code)
+			}
+		})
+	}
+}
+
+func TestPrepareStateForCommit(t *testing.T) {
+	previous := map[string]buildpackRecord{"python-guid": {LastUpdatedAt: "2016-06-08T16:41:45Z"}}
+	app := notifyApp{App: App{GUID: "app1"}, Buildpack: buildpackReleaseInfo{BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2017-06-08T16:41:45Z"}}
+
+	for _, incomplete := range []bool{false, true} {
+		state := newSavedState()
+		state.Buildpacks = copyBuildpackRecords(previous)
+		state.Buildpacks["python-guid"] = buildpackRecord{LastUpdatedAt: "2017-06-08T16:41:45Z"}
+		state.recordNotification(user1, app, nil)
+		result := &runResult{Incomplete: incomplete}
+		result.prepareStateForCommit(state, previous)
+		if rolledBack := reflect.DeepEqual(state.Buildpacks, previous); rolledBack != incomplete {
+			t.Errorf("Expected buildpack records to be rolled back to be %v. Actual %+v", incomplete, state.Buildpacks)
+		}
+		if len(state.Notifications) != 1 {
+			t.Errorf("Expected notification history to be kept. Actual %+v", state.Notifications)
+		}
+	}
+}
+
+// newTestDroplet creates a staged droplet of an app which used a buildpack.
+func newTestDroplet(guid, appGUID, createdAt, buildpack string) Droplet {
+	droplet := Droplet{GUID: guid, State: "STAGED", CreatedAt: createdAt}
+	droplet.Buildpacks = append(droplet.Buildpacks, struct {
+		Name         string `json:"name"`
+		DetectOutput string `json:"detect_output"`
+	}{Name: buildpack})
+	droplet.Relationships.App.Data.GUID = appGUID
+	return droplet
+}
+
+func TestFindOutdatedAppsCollectsErrors(t *testing.T) {
+	rolledBack := newTestDroplet("droplet4", "app4", "2016-01-01T00:00:00Z", "python_buildpack")
+	// The staged droplets of each app. app3 and app4 have staged droplets which disagree, so their current droplet is
+	// looked up.
+	droplets := map[string][]Droplet{
+		"app1": {newTestDroplet("droplet1", "app1", "2016-01-01T00:00:00Z", "python_buildpack")},
+		"app2": {newTestDroplet("droplet2", "app2", "not a time", "python_buildpack")},
+		"app3": {
+			newTestDroplet("droplet3", "app3", "2016-01-01T00:00:00Z", "python_buildpack"),
+			newTestDroplet("droplet3-new", "app3", "2017-01-01T00:00:00Z", "python_buildpack"),
+		},
+		"app4": {rolledBack, newTestDroplet("droplet4-new", "app4", "2017-01-01T00:00:00Z", "python_buildpack")},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/droplets":
+			if r.URL.Query().Get("states") != "STAGED" {
+				t.Errorf("Expected only staged droplets to be listed. Query %s", r.URL.RawQuery)
+			}
+			var resp ListResponse[Droplet]
+			for _, appGUID := range strings.Split(r.URL.Query().Get("app_guids"), ",") {
+				if appGUID == "app6" {
+					t.Errorf("Expected the droplets of opted-out apps not to be listed. Query %s", r.URL.RawQuery)
+				}
+				resp.Resources = append(resp.Resources, droplets[appGUID]...)
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/v3/apps/app3/droplets":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/v3/apps/app4/droplets":
+			if r.URL.Query().Get("current") != "true" {
+				t.Errorf("Expected the current droplet to be looked up. Query %s", r.URL.RawQuery)
+			}
+			json.NewEncoder(w).Encode(ListResponse[Droplet]{Resources: []Droplet{rolledBack}})
+		default:
+			t.Fatalf("Unable to find handler for path %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+	c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
+	apps := []App{
+		{GUID: "app1", Name: "good", State: "STARTED"},
+		{GUID: "app2", Name: "bad-time", State: "STARTED"},
+		{GUID: "app3", Name: "api-error", State: "STARTED"},
+		{GUID: "app4", Name: "rolled-back", State: "STARTED"},
+		{GUID: "app5", Name: "stopped", State: "STOPPED"},
+		{GUID: "app6", Name: "opted-out", State: "STARTED", Metadata: Metadata{Labels: map[string]string{optOutLabel: "true"}}},
+	}
+	buildpacks := map[string]Buildpack{
+		"python_buildpack": {GUID: "python-guid", Name: "python_buildpack", UpdatedAt: "2016-06-08T16:41:45Z"},
+	}
+
+	outdatedApps, err := findOutdatedApps(&c, apps, buildpacks, nil, 4)
+	if len(outdatedApps) != 2 || outdatedApps[0].GUID != "app1" || outdatedApps[1].GUID != "app4" {
+		t.Errorf("Expected app1 and app4 to be found outdated. Actual %+v", outdatedApps)
+	}
+	result := &runResult{}
+	result.addDiscoveryError(err)
+	if len(result.Errors) != 2 || !result.Incomplete {
+		t.Errorf("Expected an error for each of the apps which couldn't be checked. Actual %+v", result.Errors)
+	}
+}
+
+func TestGetCurrentDropletsForAppsWithSeveralStagedDroplets(t *testing.T) {
+	// The python buildpack was updated on 2016-06-08. app1's staged droplets are all older and app2's are all newer,
+	// so they agree. app3's disagree, so its current droplet is looked up.
+	droplets := map[string][]Droplet{
+		"app1": {
+			newTestDroplet("droplet1-old", "app1", "2016-01-01T00:00:00Z", "python_buildpack"),
+			newTestDroplet("droplet1", "app1", "2016-03-01T00:00:00Z", "python_buildpack"),
+			newTestDroplet("droplet1-older", "app1", "2015-01-01T00:00:00Z", "python_buildpack"),
+		},
+		"app2": {
+			newTestDroplet("droplet2", "app2", "2017-01-01T00:00:00Z", "python_buildpack"),
+			newTestDroplet("droplet2-old", "app2", "2016-07-01T00:00:00Z", "python_buildpack"),
+		},
+		"app3": {
+			newTestDroplet("droplet3-old", "app3", "2016-01-01T00:00:00Z", "python_buildpack"),
+			newTestDroplet("droplet3", "app3", "2017-01-01T00:00:00Z", "python_buildpack"),
+		},
+	}
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/v3/droplets":
+			var resp ListResponse[Droplet]
+			for _, appGUID := range strings.Split(r.URL.Query().Get("app_guids"), ",") {
+				resp.Resources = append(resp.Resources, droplets[appGUID]...)
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/v3/apps/app3/droplets":
+			json.NewEncoder(w).Encode(ListResponse[Droplet]{Resources: droplets["app3"][:1]})
+		default:
+			t.Errorf("Expected no lookup of the current droplet. Path %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
+	apps := []App{
+		{GUID: "app1", Name: "all-outdated", State: "STARTED"},
+		{GUID: "app2", Name: "all-current", State: "STARTED"},
+		{GUID: "app3", Name: "disagree", State: "STARTED"},
+	}
+	buildpacks := map[string]Buildpack{
+		"python_buildpack": {GUID: "python-guid", Name: "python_buildpack", UpdatedAt: "2016-06-08T16:41:45Z"},
+	}
+
+	lookups := getCurrentDropletsForApps(apps, buildpacks, &c, 4)
+	expected := []string{"droplet1", "droplet2", "droplet3-old"}
+	for i, guid := range expected {
+		if !lookups[i].found || lookups[i].err != nil || lookups[i].droplet.GUID != guid {
+			t.Errorf("Expected droplet %s for app %s. Actual %+v", guid, apps[i].GUID, lookups[i])
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Expected one request to list the droplets and one to look up app3's current droplet. Actual %d", requests)
+	}
+}
+
+func TestFindOutdatedAppsWithMultipleBuildpacks(t *testing.T) {
+	// app1 was staged with both buildpacks before they were updated, app2 after the nodejs buildpack was updated.
+	droplets := map[string]Droplet{
+		"app1": newTestDroplet("droplet1", "app1", "2016-01-01T00:00:00Z", "nodejs_buildpack"),
+		"app2": newTestDroplet("droplet2", "app2", "2016-04-01T00:00:00Z", "nodejs_buildpack"),
+	}
+	for appGUID, droplet := range droplets {
+		droplet.Buildpacks = append(droplet.Buildpacks, droplet.Buildpacks[0])
+		droplet.Buildpacks[1].Name = "python_buildpack"
+		droplets[appGUID] = droplet
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp ListResponse[Droplet]
+		for _, appGUID := range strings.Split(r.URL.Query().Get("app_guids"), ",") {
+			resp.Resources = append(resp.Resources, droplets[appGUID])
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+	c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
+	apps := []App{{GUID: "app1", Name: "both", State: "STARTED"}, {GUID: "app2", Name: "python-only", State: "STARTED"}}
+	buildpacks := map[string]Buildpack{
+		"nodejs_buildpack": {GUID: "nodejs-guid", Name: "nodejs_buildpack", Filename: "nodejs_buildpack-cflinuxfs3-v1.6.2.zip", UpdatedAt: "2016-03-01T00:00:00Z"},
+		"python_buildpack": {GUID: "python-guid", Name: "python_buildpack", Filename: "python_buildpack-cflinuxfs3-v1.7.43.zip", UpdatedAt: "2016-06-08T16:41:45Z"},
+	}
+	report := newRunReport(false)
+
+	outdatedApps, err := findOutdatedApps(&c, apps, buildpacks, report, 4)
+	if err != nil {
+		t.Fatalf("Unable to find outdated apps. Error: %s", err)
+	}
+	expected := []struct {
+		app, buildpack     string
+		outdatedBuildpacks int
+	}{
+		{"app1", "nodejs_buildpack", 2},
+		{"app1", "python_buildpack", 2},
+		{"app2", "python_buildpack", 1},
+	}
+	if len(outdatedApps) != len(expected) {
+		t.Fatalf("Expected an entry for each outdated buildpack of each app. Actual %+v", outdatedApps)
+	}
+	for i, e := range expected {
+		app := outdatedApps[i]
+		if app.GUID != e.app || app.Buildpack.BuildpackName != e.buildpack || len(app.OutdatedBuildpacks) != e.outdatedBuildpacks {
+			t.Errorf("Expected %s to be outdated by %s and %d buildpacks in all. Actual %+v", e.app, e.buildpack, e.outdatedBuildpacks, app)
+		}
+	}
+	if len(report.Apps) != 2 || len(report.Apps[0].OutdatedBuildpacks) != 2 || report.Apps[1].OutdatedBuildpacks[0].BuildpackName != "python_buildpack" {
+		t.Errorf("Expected each app to be in the report once with its outdated buildpacks. Actual %+v, %+v", report.Apps[0], report.Apps[1])
+	}
+
+	templates, _ := initTemplates()
+	mockMailer := new(mocks.Mailer)
+	mockMailer.On("SendEmail", mock.Anything).Return(nil)
+	state := newSavedState()
+	sendNotifyEmailToUsers(map[string][]notifyApp{user1: outdatedApps[:2]}, templates, mockMailer, state, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 1)
+	email := mockMailer.Calls[0].Arguments.Get(0).(message.Email)
+	if email.Subject != "Action required: restage your application" || !strings.Contains(string(email.Text), "both uses nodejs_buildpack v1.6.2, python_buildpack v1.7.43") {
+		t.Errorf("Expected one app with both buildpacks in the e-mail. Actual %s\n%s", email.Subject, email.Text)
+	}
+	if len(state.Notifications) != 2 {
+		t.Errorf("Expected the notification about each buildpack update to be recorded. Actual %+v", state.Notifications)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// A Wednesday.
+	from := time.Date(2024, 1, 10, 10, 17, 30, 0, time.UTC)
+	testCases := []struct {
+		spec         string
+		expectedNext time.Time
+		expectError  bool
+	}{
+		{"@every 1h", from.Add(time.Hour), false},
+		{"@every 30m", from.Add(30 * time.Minute), false},
+		{"@hourly", time.Date(2024, 1, 10, 11, 0, 0, 0, time.UTC), false},
+		{"@daily", time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC), false},
+		{"@weekly", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC), false},
+		{"*/15 * * * *", time.Date(2024, 1, 10, 10, 30, 0, 0, time.UTC), false},
+		{"0,20 9-17 * * *", time.Date(2024, 1, 10, 10, 20, 0, 0, time.UTC), false},
+		{"0 9 * * 1-5", time.Date(2024, 1, 11, 9, 0, 0, 0, time.UTC), false},
+		{"0 9 * * 7", time.Date(2024, 1, 14, 9, 0, 0, 0, time.UTC), false},
+		// When both days are restricted, either matches.
+		{"0 0 1 * 5", time.Date(2024, 1, 12, 0, 0, 0, 0, time.UTC), false},
+		{"30 6 29 2 *", time.Date(2024, 2, 29, 6, 30, 0, 0, time.UTC), false},
+		{"5/20 10 * * *", time.Date(2024, 1, 10, 10, 25, 0, 0, time.UTC), false},
+		{"@every 10s", time.Time{}, true},
+		{"@every soon", time.Time{}, true},
+		{"* * * *", time.Time{}, true},
+		{"60 * * * *", time.Time{}, true},
+		{"*/0 * * * *", time.Time{}, true},
+		{"5-1 * * * *", time.Time{}, true},
+		{"0 0 31 2 *", time.Time{}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			s, err := parseSchedule(tc.spec)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Test %s failed. Expected error, got none", tc.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Test %s failed. Unexpected error %s", tc.spec, err)
+			}
+			if next := s.Next(from); !next.Equal(tc.expectedNext) {
+				t.Errorf("Test %s failed. Expected next run at %s, found %s", tc.spec, tc.expectedNext, next)
+			}
+		})
+	}
+}
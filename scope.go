@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+// scope selects the orgs and spaces whose apps are checked. Each pattern is a name, a GUID or a glob like cf-*.
+// Space patterns can also be given as org/space, e.g. sandbox-*/dev. Nothing is left out when scope is empty.
+type scope struct {
+	IncludeOrgs   []string
+	ExcludeOrgs   []string
+	IncludeSpaces []string
+	ExcludeSpaces []string
+}
+
+func newScope(config Config) scope {
+	return scope{
+		IncludeOrgs:   config.IncludeOrgs,
+		ExcludeOrgs:   config.ExcludeOrgs,
+		IncludeSpaces: config.IncludeSpaces,
+		ExcludeSpaces: config.ExcludeSpaces,
+	}
+}
+
+// isEmpty checks whether the scope covers the whole foundation.
+func (s scope) isEmpty() bool {
+	return len(s.IncludeOrgs) == 0 && len(s.ExcludeOrgs) == 0 && len(s.IncludeSpaces) == 0 && len(s.ExcludeSpaces) == 0
+}
+
+// validate checks that the patterns are valid globs.
+func (s scope) validate() error {
+	for _, patterns := range [][]string{s.IncludeOrgs, s.ExcludeOrgs, s.IncludeSpaces, s.ExcludeSpaces} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid org or space pattern %q: %s", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchesAny checks whether any of the values matches any of the patterns.
+func matchesAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if matched, _ := path.Match(pattern, value); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s scope) includesOrg(org Organization) bool {
+	if len(s.IncludeOrgs) > 0 && !matchesAny(s.IncludeOrgs, org.GUID, org.Name) {
+		return false
+	}
+	return !matchesAny(s.ExcludeOrgs, org.GUID, org.Name)
+}
+
+func (s scope) includesSpace(space Space, org Organization) bool {
+	values := []string{space.GUID, space.Name, org.Name + "/" + space.Name}
+	if len(s.IncludeSpaces) > 0 && !matchesAny(s.IncludeSpaces, values...) {
+		return false
+	}
+	return !matchesAny(s.ExcludeSpaces, values...)
+}
+
+// includesApp checks whether the app is in an org and space in the scope.
+func (s scope) includesApp(app App) bool {
+	return s.includesOrg(app.Org) && s.includesSpace(app.Space, app.Org)
+}
+
+// listAppsInScope gets the apps in the orgs and spaces in the scope. When orgs or spaces are included, they are
+// looked up first so that only their apps are listed. The API can't leave resources out, so excluded orgs and
+// spaces are only left out once their apps have been listed.
+func listAppsInScope(client *cfclient.Client, s scope) ([]App, error) {
+	if len(s.IncludeOrgs) == 0 && len(s.IncludeSpaces) == 0 {
+		apps, err := ListApps(client, nil)
+		if err != nil {
+			return nil, err
+		}
+		return filterForAppsInScope(apps, s), nil
+	}
+
+	orgList, err := ListOrganizations(client)
+	if err != nil {
+		return nil, err
+	}
+	orgs := make(map[string]Organization)
+	var orgGUIDs []string
+	for _, org := range orgList {
+		if s.includesOrg(org) {
+			orgs[org.GUID] = org
+			orgGUIDs = append(orgGUIDs, org.GUID)
+		}
+	}
+	filter, guids := "organization_guids", orgGUIDs
+	if len(s.IncludeSpaces) > 0 && len(orgGUIDs) > 0 {
+		var spaces []Space
+		for _, batch := range batchGUIDs(orgGUIDs) {
+			spacesInBatch, err := ListSpaces(client, url.Values{"organization_guids": []string{strings.Join(batch, ",")}})
+			if err != nil {
+				return nil, err
+			}
+			spaces = append(spaces, spacesInBatch...)
+		}
+		var spaceGUIDs []string
+		for _, space := range spaces {
+			if s.includesSpace(space, orgs[space.Relationships.Organization.Data.GUID]) {
+				spaceGUIDs = append(spaceGUIDs, space.GUID)
+			}
+		}
+		filter, guids = "space_guids", spaceGUIDs
+	}
+	if len(guids) == 0 {
+		log.Println("No orgs or spaces are in scope")
+		return nil, nil
+	}
+	log.Printf("Listing the apps in %d %s\n", len(guids), strings.TrimSuffix(filter, "_guids")+"s")
+
+	var apps []App
+	for _, batch := range batchGUIDs(guids) {
+		appsInBatch, err := ListApps(client, url.Values{filter: []string{strings.Join(batch, ",")}})
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, appsInBatch...)
+	}
+	return filterForAppsInScope(apps, s), nil
+}
+
+// filterForAppsInScope gets the apps in orgs and spaces in the scope.
+func filterForAppsInScope(apps []App, s scope) []App {
+	var filteredApps []App
+	for _, app := range apps {
+		if s.includesApp(app) {
+			filteredApps = append(filteredApps, app)
+		}
+	}
+	if skipped := len(apps) - len(filteredApps); skipped > 0 {
+		log.Printf("Skipping %d apps in orgs and spaces which are out of scope\n", skipped)
+	}
+	return filteredApps
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+func TestScopeIncludesApp(t *testing.T) {
+	newApp := func(org, space string) App {
+		return App{Org: Organization{GUID: org + "-guid", Name: org}, Space: Space{GUID: space + "-guid", Name: space}}
+	}
+	testCases := []struct {
+		name     string
+		scope    scope
+		app      App
+		expected bool
+	}{
+		{"empty scope", scope{}, newApp("sandbox", "dev"), true},
+		{"included org", scope{IncludeOrgs: []string{"sandbox"}}, newApp("sandbox", "dev"), true},
+		{"org not included", scope{IncludeOrgs: []string{"sandbox"}}, newApp("paid-org", "dev"), false},
+		{"included org by GUID", scope{IncludeOrgs: []string{"sandbox-guid"}}, newApp("sandbox", "dev"), true},
+		{"excluded org by glob", scope{ExcludeOrgs: []string{"cf-*"}}, newApp("cf-system", "dev"), false},
+		{"org not excluded by glob", scope{ExcludeOrgs: []string{"cf-*"}}, newApp("sandbox", "dev"), true},
+		{"exclude wins", scope{IncludeOrgs: []string{"*"}, ExcludeOrgs: []string{"system"}}, newApp("system", "dev"), false},
+		{"included space", scope{IncludeSpaces: []string{"dev"}}, newApp("sandbox", "dev"), true},
+		{"space not included", scope{IncludeSpaces: []string{"dev"}}, newApp("sandbox", "prod"), false},
+		{"included org and space", scope{IncludeSpaces: []string{"sandbox-*/dev"}}, newApp("sandbox-1", "dev"), true},
+		{"space in other org", scope{IncludeSpaces: []string{"sandbox-*/dev"}}, newApp("paid-org", "dev"), false},
+		{"excluded space by GUID", scope{ExcludeSpaces: []string{"dev-guid"}}, newApp("sandbox", "dev"), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := tc.scope.includesApp(tc.app); actual != tc.expected {
+				t.Errorf("Test %s failed. Expected %v, found %v", tc.name, tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestScopeValidate(t *testing.T) {
+	if err := (scope{IncludeOrgs: []string{"cf-*", "sandbox"}}).validate(); err != nil {
+		t.Errorf("Expected patterns to be valid. Error %s", err)
+	}
+	if err := (scope{ExcludeSpaces: []string{"[dev"}}).validate(); err == nil {
+		t.Error("Expected malformed pattern to be invalid")
+	}
+}
+
+func TestListAppsInScope(t *testing.T) {
+	orgs := []Organization{{GUID: "org1", Name: "sandbox-1"}, {GUID: "org2", Name: "sandbox-2"}, {GUID: "org3", Name: "system"}}
+	spaces := map[string][]Space{"org1": {{GUID: "space1", Name: "dev"}, {GUID: "space2", Name: "prod"}}, "org2": {{GUID: "space3", Name: "dev"}}}
+	for orgGUID, spacesInOrg := range spaces {
+		for i := range spacesInOrg {
+			spacesInOrg[i].Relationships.Organization.Data.GUID = orgGUID
+		}
+	}
+	testCases := []struct {
+		name           string
+		scope          scope
+		expectedFilter string
+		expectedApps   []string
+	}{
+		{"everything", scope{}, "", []string{"app1", "app2", "app3", "app4"}},
+		{"excluded org", scope{ExcludeOrgs: []string{"system"}}, "", []string{"app1", "app2", "app3"}},
+		{"included orgs", scope{IncludeOrgs: []string{"sandbox-*"}}, "organization_guids=org1,org2", []string{"app1", "app2", "app3"}},
+		{"included spaces", scope{IncludeOrgs: []string{"sandbox-*"}, IncludeSpaces: []string{"dev"}}, "space_guids=space1,space3", []string{"app1", "app3"}},
+		{"included spaces in any org", scope{IncludeSpaces: []string{"sandbox-1/*"}, ExcludeSpaces: []string{"prod"}}, "space_guids=space1", []string{"app1"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var appFilters []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				encoder := json.NewEncoder(w)
+				query := r.URL.Query()
+				switch r.URL.Path {
+				case "/v3/organizations":
+					encoder.Encode(ListResponse[Organization]{Resources: orgs})
+				case "/v3/spaces":
+					var resp ListResponse[Space]
+					for _, orgGUID := range strings.Split(query.Get("organization_guids"), ",") {
+						resp.Resources = append(resp.Resources, spaces[orgGUID]...)
+					}
+					encoder.Encode(resp)
+				case "/v3/apps":
+					filter := ""
+					for _, key := range []string{"organization_guids", "space_guids"} {
+						if query.Get(key) != "" {
+							filter = key + "=" + query.Get(key)
+						}
+					}
+					appFilters = append(appFilters, filter)
+					// The server only filters by space, which is enough to check the apps are filtered again.
+					var resp ListResponse[App]
+					for i, spaceGUID := range []string{"space1", "space2", "space3", "space4"} {
+						if !strings.HasPrefix(filter, "space_guids") || strings.Contains(filter, spaceGUID) {
+							app := App{GUID: "app" + string(rune('1'+i))}
+							app.Relationships.Space.Data.GUID = spaceGUID
+							resp.Resources = append(resp.Resources, app)
+						}
+					}
+					resp.Included.Organizations = orgs
+					resp.Included.Spaces = append(append(spaces["org1"], spaces["org2"]...), Space{GUID: "space4", Name: "ops"})
+					resp.Included.Spaces[3].Relationships.Organization.Data.GUID = "org3"
+					encoder.Encode(resp)
+				default:
+					t.Fatalf("Unable to find handler for path %s", r.URL.Path)
+				}
+			}))
+			defer ts.Close()
+			c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
+
+			apps, err := listAppsInScope(&c, tc.scope)
+			if err != nil {
+				t.Fatalf("Test %s failed. Unable to list apps. Error: %s", tc.name, err)
+			}
+			if len(appFilters) != 1 || appFilters[0] != tc.expectedFilter {
+				t.Errorf("Test %s failed. Expected apps to be listed with filter %q, found %q", tc.name, tc.expectedFilter, appFilters)
+			}
+			var actual []string
+			for _, app := range apps {
+				actual = append(actual, app.GUID)
+			}
+			if strings.Join(actual, ",") != strings.Join(tc.expectedApps, ",") {
+				t.Errorf("Test %s failed. Expected apps %v, found %v", tc.name, tc.expectedApps, actual)
+			}
+		})
+	}
+}
+
+func TestGetAppsAndBuildpacksOnlyRecordsUnscopedRuns(t *testing.T) {
+	testCases := []struct {
+		name           string
+		config         Config
+		expectRecorded bool
+	}{
+		{"whole foundation", Config{}, true},
+		{"included orgs", Config{IncludeOrgs: []string{"sandbox-*"}}, false},
+		{"excluded spaces", Config{ExcludeSpaces: []string{"cf-system/*"}}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				encoder := json.NewEncoder(w)
+				switch r.URL.Path {
+				case "/v3/organizations":
+					encoder.Encode(ListResponse[Organization]{Resources: []Organization{{GUID: "org1", Name: "sandbox-1"}}})
+				case "/v3/spaces":
+					encoder.Encode(ListResponse[Space]{})
+				case "/v3/apps":
+					encoder.Encode(ListResponse[App]{})
+				case "/v3/buildpacks":
+					encoder.Encode(ListResponse[Buildpack]{Resources: []Buildpack{{GUID: "bp1", Name: "ruby_buildpack", UpdatedAt: "2020-01-01T00:00:00Z"}}})
+				default:
+					t.Fatalf("Unable to find handler for path %s", r.URL.Path)
+				}
+			}))
+			defer ts.Close()
+			c := cfclient.Client{Config: cfclient.Config{HttpClient: http.DefaultClient, ApiAddress: ts.URL}}
+			state := newSavedState()
+
+			_, buildpacks, err := getAppsAndBuildpacks(&c, state, tc.config, &runResult{Report: newRunReport(false)})
+			if err != nil {
+				t.Fatalf("Test %s failed. Unexpected error %s", tc.name, err)
+			}
+			if _, found := buildpacks["ruby_buildpack"]; !found {
+				t.Errorf("Test %s failed. Expected the updated buildpack to be checked, found %v", tc.name, buildpacks)
+			}
+			if _, recorded := state.Buildpacks["bp1"]; recorded != tc.expectRecorded {
+				t.Errorf("Test %s failed. Expected buildpack update recorded %t, found %v", tc.name, tc.expectRecorded, state.Buildpacks)
+			}
+		})
+	}
+}
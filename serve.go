@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// service runs checks on a schedule and reports its health.
+type service struct {
+	schedule schedule
+	// runOnce does a run and gets its exit code.
+	runOnce func() int
+
+	mu     sync.Mutex
+	status serviceStatus
+	// done is closed when the current run finishes.
+	done chan struct{}
+}
+
+// serviceStatus is what the health endpoint reports.
+type serviceStatus struct {
+	Running           bool   `json:"running"`
+	LastRunStartedAt  string `json:"last_run_started_at,omitempty"`
+	LastRunFinishedAt string `json:"last_run_finished_at,omitempty"`
+	LastExitCode      *int   `json:"last_exit_code,omitempty"`
+	SkippedRuns       int    `json:"skipped_runs"`
+	NextRunAt         string `json:"next_run_at,omitempty"`
+}
+
+func newService(s schedule, runOnce func() int) *service {
+	return &service{schedule: s, runOnce: runOnce}
+}
+
+// start starts a run unless one is still going, in which case the run is skipped. It returns whether a run was
+// started and a channel which is closed when the run finishes.
+func (s *service) start() (bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.Running {
+		s.status.SkippedRuns++
+		log.Println("Skipping run because the last run is still going")
+		return false, s.done
+	}
+	s.status.Running = true
+	s.status.LastRunStartedAt = time.Now().UTC().Format(time.RFC3339)
+	s.done = make(chan struct{})
+	done := s.done
+	go func() {
+		exitCode := s.runOnce()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.status.Running = false
+		s.status.LastRunFinishedAt = time.Now().UTC().Format(time.RFC3339)
+		s.status.LastExitCode = &exitCode
+		close(done)
+	}()
+	return true, done
+}
+
+// loop starts runs on the schedule until the context is done, and then waits for the current run to finish.
+func (s *service) loop(ctx context.Context) {
+	for {
+		next := s.schedule.Next(time.Now())
+		s.mu.Lock()
+		s.status.NextRunAt = next.UTC().Format(time.RFC3339)
+		done := s.done
+		s.mu.Unlock()
+		log.Printf("Next run at %s\n", next.Format(time.RFC3339))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if done != nil {
+				<-done
+			}
+			return
+		case <-timer.C:
+			s.start()
+		}
+	}
+}
+
+// ServeHTTP reports the health of the service as JSON.
+func (s *service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	status := s.status
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// serve runs the service and its health endpoint until the context is done.
+func serve(ctx context.Context, addr string, s *service) error {
+	mux := http.NewServeMux()
+	mux.Handle("/health", s)
+	mux.Handle("/metrics", appMetrics)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	log.Printf("Serving health and metrics endpoints on %s\n", addr)
+
+	loopDone := make(chan struct{})
+	go func() {
+		s.loop(ctx)
+		close(loopDone)
+	}()
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+	log.Println("Shutting down after the current run")
+	<-loopDone
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServiceRefusesOverlappingRuns(t *testing.T) {
+	release := make(chan struct{})
+	runs := 0
+	service := newService(everySchedule{time.Hour}, func() int {
+		runs++
+		<-release
+		return exitPartialSuccess
+	})
+
+	started, done := service.start()
+	if !started {
+		t.Fatal("Expected the first run to start")
+	}
+	if started, _ := service.start(); started {
+		t.Error("Expected the second run to be skipped while the first is going")
+	}
+	recorder := httptest.NewRecorder()
+	service.ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+	var status serviceStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatalf("Unable to decode status. Error: %s", err.Error())
+	}
+	if !status.Running || status.SkippedRuns != 1 || status.LastExitCode != nil {
+		t.Errorf("Unexpected status while running %+v", status)
+	}
+
+	close(release)
+	<-done
+	recorder = httptest.NewRecorder()
+	service.ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+	status = serviceStatus{}
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatalf("Unable to decode status. Error: %s", err.Error())
+	}
+	if status.Running || status.LastExitCode == nil || *status.LastExitCode != exitPartialSuccess || status.LastRunFinishedAt == "" {
+		t.Errorf("Unexpected status after the run %+v", status)
+	}
+	started, done = service.start()
+	if !started {
+		t.Fatal("Expected a run to start after the last one finished")
+	}
+	<-done
+	if runs != 2 {
+		t.Errorf("Expected 2 runs, found %d", runs)
+	}
+}
+
+func TestServiceLoopWaitsForRun(t *testing.T) {
+	running := make(chan struct{})
+	finished := false
+	service := newService(everySchedule{time.Millisecond}, func() int {
+		close(running)
+		time.Sleep(20 * time.Millisecond)
+		finished = true
+		return exitSuccess
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	loopDone := make(chan struct{})
+	go func() {
+		service.loop(ctx)
+		close(loopDone)
+	}()
+	<-running
+	cancel()
+	<-loopDone
+	if !finished {
+		t.Error("Expected the loop to wait for the run to finish")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// snoozeAnnotation on an app is a date like 2006-01-02 until which no reminders are sent about it.
+	snoozeAnnotation = "buildpack-notify.cloud.gov/snooze-until"
+	// snoozeDateLayout is the layout of the dates apps are snoozed until.
+	snoozeDateLayout = "2006-01-02"
+)
+
+// snoozeExpiresAt gets when a snooze until the date ends, which is the end of that day in UTC.
+func snoozeExpiresAt(until string) (time.Time, error) {
+	date, err := time.Parse(snoozeDateLayout, until)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return date.AddDate(0, 0, 1), nil
+}
+
+// snooze records that no reminders are sent about the app being outdated by the buildpack release until the date.
+// A date which has passed ends the snooze.
+func (s *savedState) snooze(appGUID, buildpackGUID, buildpackUpdatedAt, until string, now time.Time) {
+	s.Snoozes[appReleaseKey(appGUID, buildpackGUID, buildpackUpdatedAt)] = snoozeRecord{
+		AppGUID:            appGUID,
+		BuildpackGUID:      buildpackGUID,
+		BuildpackUpdatedAt: buildpackUpdatedAt,
+		Until:              until,
+		CreatedAt:          now.UTC().Format(time.RFC3339),
+	}
+}
+
+// snoozedUntil gets the date until which reminders about the app are snoozed by the state or the app's snooze
+// annotation, or "" if they aren't. If both snooze the app, the later date is used.
+func (s *savedState) snoozedUntil(app notifyApp, now time.Time) string {
+	dates := []string{app.Metadata.Annotations[snoozeAnnotation]}
+	if snooze, found := s.Snoozes[appReleaseKey(app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)]; found {
+		dates = append(dates, snooze.Until)
+	}
+	var until string
+	var latest time.Time
+	for _, date := range dates {
+		if date == "" {
+			continue
+		}
+		expiresAt, err := snoozeExpiresAt(date)
+		if err != nil {
+			log.Printf("Ignoring snooze of app %s guid %s until %s because invalid date\n", app.Name, app.GUID, date)
+			continue
+		}
+		if expiresAt.After(now) && expiresAt.After(latest) {
+			until, latest = date, expiresAt
+		}
+	}
+	return until
+}
+
+// applySnoozes sets when reminders about each app are snoozed until.
+func applySnoozes(apps []notifyApp, state *savedState, now time.Time) {
+	for i, app := range apps {
+		if until := state.snoozedUntil(app, now); until != "" {
+			log.Printf("App %s Guid %s | Buildpack %s reminders snoozed until %s\n", app.Name, app.GUID, app.Buildpack.BuildpackName, until)
+			apps[i].SnoozedUntil = until
+		}
+	}
+}
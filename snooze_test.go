@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloud-gov/buildpack-notify/mocks"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSnoozedUntil(t *testing.T) {
+	now := time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC)
+	pythonBuildpack := buildpackReleaseInfo{BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}
+	newApp := func(annotation string) notifyApp {
+		app := notifyApp{App: App{GUID: "app1"}, Buildpack: pythonBuildpack}
+		if annotation != "" {
+			app.Metadata.Annotations = map[string]string{snoozeAnnotation: annotation}
+		}
+		return app
+	}
+	testCases := []struct {
+		name     string
+		app      notifyApp
+		snooze   string
+		expected string
+	}{
+		{"not snoozed", newApp(""), "", ""},
+		{"snoozed in state", newApp(""), "2016-07-15", "2016-07-15"},
+		{"snoozed until today", newApp(""), "2016-07-01", "2016-07-01"},
+		{"snooze expired", newApp(""), "2016-06-30", ""},
+		{"snoozed by annotation", newApp("2016-08-01"), "", "2016-08-01"},
+		{"later snooze wins", newApp("2016-08-01"), "2016-07-15", "2016-08-01"},
+		{"expired annotation", newApp("2016-06-01"), "2016-07-15", "2016-07-15"},
+		{"invalid annotation", newApp("next week"), "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := newSavedState()
+			if tc.snooze != "" {
+				state.snooze("app1", "python-guid", "2016-06-08T16:41:45Z", tc.snooze, now)
+			}
+			if actual := state.snoozedUntil(tc.app, now); actual != tc.expected {
+				t.Errorf("Test %s failed. Expected %q, found %q", tc.name, tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSnoozedAppsAreNotReminded(t *testing.T) {
+	pythonBuildpack := buildpackReleaseInfo{BuildpackName: "python_buildpack", BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}
+	apps := []notifyApp{
+		{App: App{GUID: "app1", Name: "snoozed"}, Buildpack: pythonBuildpack},
+		{App: App{GUID: "app2", Name: "other-release"}, Buildpack: pythonBuildpack},
+	}
+	state := newSavedState()
+	for _, app := range apps {
+		state.Notifications[notificationKey(user1, app.GUID, "python-guid", "2016-06-08T16:41:45Z")] = notificationRecord{
+			Recipient: user1, AppGUID: app.GUID, BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z",
+			Attempts: 1, SentAt: time.Now().Add(-8 * 24 * time.Hour).UTC().Format(time.RFC3339),
+		}
+	}
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format(snoozeDateLayout)
+	state.snooze("app1", "python-guid", "2016-06-08T16:41:45Z", tomorrow, time.Now())
+	// Snoozing an earlier release of the buildpack doesn't snooze this one.
+	state.snooze("app2", "python-guid", "2016-01-01T00:00:00Z", tomorrow, time.Now())
+	report := newRunReport(false)
+	for _, app := range apps {
+		report.addApp(app.App, decisionOutdated, &app.Buildpack)
+	}
+
+	applySnoozes(apps, state, time.Now())
+	report.addSnoozes(apps)
+	if apps[0].SnoozedUntil != tomorrow || apps[1].SnoozedUntil != "" {
+		t.Errorf("Expected only app1 to be snoozed. Actual %+v", apps)
+	}
+	if report.Apps[0].SnoozedUntil != tomorrow || report.Apps[1].SnoozedUntil != "" {
+		t.Errorf("Expected the snooze to be in the report. Actual %+v, %+v", report.Apps[0], report.Apps[1])
+	}
+
+	templates, _ := initTemplates()
+	mockMailer := new(mocks.Mailer)
+	mockMailer.On("SendEmail", mock.Anything).Return(nil)
+	sendReminderEmailToUsers(map[string][]notifyApp{user1: apps}, templates, mockMailer, state, []int{7}, false)
+	mockMailer.AssertNumberOfCalls(t, "SendEmail", 1)
+	if _, found := state.Reminders[notificationKey(user1, "app1", "python-guid", "2016-06-08T16:41:45Z")]; found {
+		t.Error("Expected no reminder about the snoozed app")
+	}
+	if _, found := state.Reminders[notificationKey(user1, "app2", "python-guid", "2016-06-08T16:41:45Z")]; !found {
+		t.Error("Expected a reminder about the app which isn't snoozed")
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// stateSchemaVersion is the version of the state format written by this version of the tool.
+// Bump it and add a migration to stateMigrations only when existing state has to be transformed. New maps need
+// neither, since decodeState creates the ones which are missing.
+const stateSchemaVersion = 1
+
+// version is the version of the tool. It is set at build time with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
+type buildpackRecord struct {
+	LastUpdatedAt string
+}
+
+// notificationRecord tracks telling one recipient about one app being outdated by one buildpack release.
+// A record without SentAt has only failed so far and will be retried on the next run.
+type notificationRecord struct {
+	Recipient          string
+	AppGUID            string
+	BuildpackGUID      string
+	BuildpackUpdatedAt string
+	Attempts           int
+	LastAttemptAt      string
+	LastError          string `json:",omitempty"`
+	SentAt             string `json:",omitempty"`
+}
+
+// reminderRecord tracks reminding one recipient about one app being outdated by one buildpack release.
+// SentAt is when the last reminder was sent and RemindersSent counts them.
+type reminderRecord struct {
+	notificationRecord
+	RemindersSent int
+}
+
+// snoozeRecord tracks an app's owners acknowledging that a buildpack release outdated the app. No reminders are
+// sent about the app and release until the end of the day Until, a date like 2006-01-02, in UTC.
+type snoozeRecord struct {
+	AppGUID            string
+	BuildpackGUID      string
+	BuildpackUpdatedAt string
+	Until              string
+	CreatedAt          string
+}
+
+// remindersDue counts the reminders that should have been sent by now according to the schedule, which is the
+// number of days after the first notification that each reminder should go out. A reminder is due when fewer
+// reminders than this were sent; if several were missed, only one is sent.
+func remindersDue(firstNotifiedAt time.Time, schedule []int, now time.Time) int {
+	count := 0
+	for _, days := range schedule {
+		if now.Sub(firstNotifiedAt) >= time.Duration(days)*24*time.Hour {
+			count++
+		}
+	}
+	return count
+}
+
+// savedState is the state kept between runs.
+type savedState struct {
+	SchemaVersion int                        `json:"schema_version"`
+	WrittenAt     string                     `json:"written_at,omitempty"`
+	ToolVersion   string                     `json:"tool_version,omitempty"`
+	Buildpacks    map[string]buildpackRecord `json:"buildpacks"`
+	// Notifications is keyed by notificationKey.
+	Notifications map[string]notificationRecord `json:"notifications"`
+	// Escalations to org managers about apps which stayed outdated, keyed by notificationKey.
+	Escalations map[string]notificationRecord `json:"escalations"`
+	// Reminders about apps which are still outdated, keyed by notificationKey.
+	Reminders map[string]reminderRecord `json:"reminders"`
+	// Webhooks are the webhook deliveries about outdated apps, keyed by notificationKey with the webhook URL as recipient.
+	Webhooks map[string]notificationRecord `json:"webhooks"`
+	// Snoozes of reminders about apps, keyed by appReleaseKey.
+	Snoozes map[string]snoozeRecord `json:"snoozes"`
+}
+
+// newSavedState creates empty state at the current schema version.
+func newSavedState() *savedState {
+	return &savedState{
+		SchemaVersion: stateSchemaVersion,
+		Buildpacks:    make(map[string]buildpackRecord),
+		Notifications: make(map[string]notificationRecord),
+		Escalations:   make(map[string]notificationRecord),
+		Reminders:     make(map[string]reminderRecord),
+		Webhooks:      make(map[string]notificationRecord),
+		Snoozes:       make(map[string]snoozeRecord),
+	}
+}
+
+// stateMigrations upgrade raw state from the schema version at their index to the next one.
+var stateMigrations = []func([]byte) ([]byte, error){
+	migrateUnversionedState,
+}
+
+// migrateUnversionedState upgrades the original format, which was a bare map of
+// buildpack GUID to buildpackRecord, to schema version 1.
+func migrateUnversionedState(data []byte) ([]byte, error) {
+	var buildpacks map[string]buildpackRecord
+	if err := json.Unmarshal(data, &buildpacks); err != nil {
+		return nil, err
+	}
+	if buildpacks == nil {
+		buildpacks = make(map[string]buildpackRecord)
+	}
+	return json.Marshal(map[string]interface{}{
+		"schema_version": 1,
+		"buildpacks":     buildpacks,
+	})
+}
+
+// decodeState reads state in any known schema version and migrates it to the current one.
+// The migrated state is written out in the current format on the next save.
+func decodeState(r io.Reader) (*savedState, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	if header.SchemaVersion > stateSchemaVersion {
+		return nil, fmt.Errorf("state schema version %d is newer than supported version %d",
+			header.SchemaVersion, stateSchemaVersion)
+	}
+	for schemaVersion := header.SchemaVersion; schemaVersion < stateSchemaVersion; schemaVersion++ {
+		log.Printf("Migrating state from schema version %d to %d\n", schemaVersion, schemaVersion+1)
+		if data, err = stateMigrations[schemaVersion](data); err != nil {
+			return nil, fmt.Errorf("unable to migrate state from schema version %d: %s", schemaVersion, err)
+		}
+	}
+	state := newSavedState()
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Buildpacks == nil {
+		state.Buildpacks = make(map[string]buildpackRecord)
+	}
+	if state.Notifications == nil {
+		state.Notifications = make(map[string]notificationRecord)
+	}
+	if state.Escalations == nil {
+		state.Escalations = make(map[string]notificationRecord)
+	}
+	if state.Reminders == nil {
+		state.Reminders = make(map[string]reminderRecord)
+	}
+	if state.Webhooks == nil {
+		state.Webhooks = make(map[string]notificationRecord)
+	}
+	if state.Snoozes == nil {
+		state.Snoozes = make(map[string]snoozeRecord)
+	}
+	return state, nil
+}
+
+// encodeState writes state in the current schema version, stamped with when and by what it was written.
+func encodeState(w io.Writer, state *savedState) error {
+	state.SchemaVersion = stateSchemaVersion
+	state.WrittenAt = time.Now().UTC().Format(time.RFC3339)
+	state.ToolVersion = version
+	return json.NewEncoder(w).Encode(state)
+}
+
+// releaseKey identifies a buildpack release by the buildpack GUID and when it was updated.
+func releaseKey(buildpackGUID, buildpackUpdatedAt string) string {
+	return buildpackGUID + "@" + buildpackUpdatedAt
+}
+
+// notificationKey identifies telling a recipient about an app being outdated by a buildpack release.
+func notificationKey(recipient, appGUID, buildpackGUID, buildpackUpdatedAt string) string {
+	return recipient + "|" + appGUID + "|" + releaseKey(buildpackGUID, buildpackUpdatedAt)
+}
+
+// hasPendingNotifications checks whether any notifications or webhook deliveries about the buildpack release
+// have failed and not been sent since.
+func (s *savedState) hasPendingNotifications(buildpackGUID, buildpackUpdatedAt string) bool {
+	for _, records := range []map[string]notificationRecord{s.Notifications, s.Webhooks} {
+		for _, record := range records {
+			if record.BuildpackGUID == buildpackGUID && record.BuildpackUpdatedAt == buildpackUpdatedAt && record.SentAt == "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// remindersSentCounts indexes the fewest reminders sent to any recipient of an app about a buildpack release
+// by appReleaseKey.
+func (s *savedState) remindersSentCounts() map[string]int {
+	remindersSent := make(map[string]int)
+	for _, record := range s.Reminders {
+		key := appReleaseKey(record.AppGUID, record.BuildpackGUID, record.BuildpackUpdatedAt)
+		if sent, found := remindersSent[key]; !found || record.RemindersSent < sent {
+			remindersSent[key] = record.RemindersSent
+		}
+	}
+	return remindersSent
+}
+
+// hasDueReminders checks whether any reminders about the buildpack release may be due.
+// Reminders are due for an app when fewer reminders than are due were sent to any of its recipients,
+// or when nobody was reminded about it yet. firstNotified and remindersSent are the indexes from
+// firstNotifiedTimes and remindersSentCounts, which are built once for all the buildpacks.
+func (s *savedState) hasDueReminders(buildpackGUID, buildpackUpdatedAt string, schedule []int, now time.Time, firstNotified map[string]time.Time, remindersSent map[string]int) bool {
+	for _, record := range s.Notifications {
+		if record.BuildpackGUID != buildpackGUID || record.BuildpackUpdatedAt != buildpackUpdatedAt {
+			continue
+		}
+		key := appReleaseKey(record.AppGUID, buildpackGUID, buildpackUpdatedAt)
+		firstNotifiedAt, found := firstNotified[key]
+		if !found {
+			continue
+		}
+		if remindersDue(firstNotifiedAt, schedule, now) > remindersSent[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// reminderDue checks whether the recipient should be reminded about the app. It also returns how many
+// reminders will have been sent to them once the reminder goes out. firstNotified is the index from
+// firstNotifiedTimes.
+func (s *savedState) reminderDue(recipient string, app notifyApp, schedule []int, now time.Time, firstNotified map[string]time.Time) (int, bool) {
+	firstNotifiedAt, found := firstNotified[appReleaseKey(app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)]
+	if !found {
+		return 0, false
+	}
+	count := remindersDue(firstNotifiedAt, schedule, now)
+	record := s.Reminders[notificationKey(recipient, app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)]
+	return count, count > record.RemindersSent
+}
+
+// notifiedReleases returns the keys of the buildpack releases which notifications have already been attempted for.
+func (s *savedState) notifiedReleases() map[string]bool {
+	releases := make(map[string]bool)
+	for _, record := range s.Notifications {
+		releases[releaseKey(record.BuildpackGUID, record.BuildpackUpdatedAt)] = true
+	}
+	return releases
+}
+
+// notifiedApps returns the keys of the apps and buildpack releases which notifications have already been attempted for.
+func (s *savedState) notifiedApps() map[string]bool {
+	apps := make(map[string]bool)
+	for _, record := range s.Notifications {
+		apps[appReleaseKey(record.AppGUID, record.BuildpackGUID, record.BuildpackUpdatedAt)] = true
+	}
+	return apps
+}
+
+// recordNotification records the outcome of an attempt to notify a recipient about an app.
+func (s *savedState) recordNotification(recipient string, app notifyApp, sendErr error) {
+	recordAttempt(s.Notifications, recipient, app, sendErr)
+}
+
+// recordEscalation records the outcome of an attempt to escalate an app to a recipient.
+func (s *savedState) recordEscalation(recipient string, app notifyApp, sendErr error) {
+	recordAttempt(s.Escalations, recipient, app, sendErr)
+}
+
+// recordWebhook records the outcome of an attempt to deliver a webhook event about an app.
+func (s *savedState) recordWebhook(webhookURL string, app notifyApp, sendErr error) {
+	recordAttempt(s.Webhooks, webhookURL, app, sendErr)
+}
+
+// isWebhookDelivered checks whether the event about the app has been delivered to the webhook.
+func (s *savedState) isWebhookDelivered(webhookURL string, app notifyApp) bool {
+	record, found := s.Webhooks[notificationKey(webhookURL, app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)]
+	return found && record.SentAt != ""
+}
+
+// deferWebhook records a webhook event about an app which wasn't attempted in this run,
+// so it is pending and delivered in the next run. Events which already have a record are left as they are.
+func (s *savedState) deferWebhook(webhookURL string, app notifyApp, reason string) {
+	key := notificationKey(webhookURL, app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)
+	if _, found := s.Webhooks[key]; !found {
+		record := newNotificationRecord(webhookURL, app)
+		record.LastError = reason
+		s.Webhooks[key] = record
+	}
+}
+
+// newNotificationRecord creates the record about sending a recipient something about an app, before any attempts.
+func newNotificationRecord(recipient string, app notifyApp) notificationRecord {
+	return notificationRecord{
+		Recipient:          recipient,
+		AppGUID:            app.GUID,
+		BuildpackGUID:      app.Buildpack.BuildpackGUID,
+		BuildpackUpdatedAt: app.Buildpack.BuildpackUpdatedAt,
+	}
+}
+
+// recordAttempt records the outcome of an attempt to send a recipient an e-mail about an app.
+func recordAttempt(records map[string]notificationRecord, recipient string, app notifyApp, sendErr error) {
+	key := notificationKey(recipient, app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)
+	records[key] = addAttempt(records[key], recipient, app, sendErr)
+}
+
+// addAttempt adds the outcome of an attempt to the record, which is new if it has no recipient yet.
+func addAttempt(record notificationRecord, recipient string, app notifyApp, sendErr error) notificationRecord {
+	if record.Recipient == "" {
+		record = newNotificationRecord(recipient, app)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	record.Attempts++
+	record.LastAttemptAt = now
+	if sendErr != nil {
+		record.LastError = sendErr.Error()
+	} else {
+		record.LastError = ""
+		record.SentAt = now
+	}
+	return record
+}
+
+// recordReminder records the outcome of an attempt to remind a recipient about an app.
+func (s *savedState) recordReminder(recipient string, app notifyApp, remindersSent int, sendErr error) {
+	key := notificationKey(recipient, app.GUID, app.Buildpack.BuildpackGUID, app.Buildpack.BuildpackUpdatedAt)
+	record := s.Reminders[key]
+	record.notificationRecord = addAttempt(record.notificationRecord, recipient, app, sendErr)
+	if sendErr == nil {
+		record.RemindersSent = remindersSent
+	}
+	s.Reminders[key] = record
+}
+
+// reminderAttempts gets the reminder records without their counts, like the other delivery records.
+func (s *savedState) reminderAttempts() map[string]notificationRecord {
+	attempts := make(map[string]notificationRecord, len(s.Reminders))
+	for key, record := range s.Reminders {
+		attempts[key] = record.notificationRecord
+	}
+	return attempts
+}
+
+// deleteRecords removes the notification, reminder, escalation and webhook records which match.
+func (s *savedState) deleteRecords(match func(notificationRecord) bool) {
+	for _, records := range []map[string]notificationRecord{s.Notifications, s.Escalations, s.Webhooks} {
+		for key, record := range records {
+			if match(record) {
+				delete(records, key)
+			}
+		}
+	}
+	for key, record := range s.Reminders {
+		if match(record.notificationRecord) {
+			delete(s.Reminders, key)
+		}
+	}
+}
+
+// pruneNotifications removes the history of buildpack releases which are no longer current.
+func (s *savedState) pruneNotifications(buildpacks []Buildpack) {
+	current := make(map[string]bool)
+	for _, buildpack := range buildpacks {
+		current[releaseKey(buildpack.GUID, buildpack.UpdatedAt)] = true
+	}
+	s.deleteRecords(func(record notificationRecord) bool {
+		return !current[releaseKey(record.BuildpackGUID, record.BuildpackUpdatedAt)]
+	})
+	for key, snooze := range s.Snoozes {
+		if !current[releaseKey(snooze.BuildpackGUID, snooze.BuildpackUpdatedAt)] {
+			delete(s.Snoozes, key)
+		}
+	}
+}
+
+// knowsBuildpack checks if there is any state about the buildpack.
+func (s *savedState) knowsBuildpack(buildpackGUID string) bool {
+	if _, found := s.Buildpacks[buildpackGUID]; found {
+		return true
+	}
+	for _, records := range []map[string]notificationRecord{s.Notifications, s.reminderAttempts(), s.Escalations, s.Webhooks} {
+		for _, record := range records {
+			if record.BuildpackGUID == buildpackGUID {
+				return true
+			}
+		}
+	}
+	for _, snooze := range s.Snoozes {
+		if snooze.BuildpackGUID == buildpackGUID {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetBuildpack removes the buildpack's last update, the history of notifications about it and its snoozes, so
+// the next run handles its current release as if it was new.
+func (s *savedState) forgetBuildpack(buildpackGUID string) {
+	delete(s.Buildpacks, buildpackGUID)
+	s.deleteRecords(func(record notificationRecord) bool {
+		return record.BuildpackGUID == buildpackGUID
+	})
+	for key, snooze := range s.Snoozes {
+		if snooze.BuildpackGUID == buildpackGUID {
+			delete(s.Snoozes, key)
+		}
+	}
+}
+
+// appReleaseKey identifies an app being outdated by a buildpack release.
+func appReleaseKey(appGUID, buildpackGUID, buildpackUpdatedAt string) string {
+	return appGUID + "|" + releaseKey(buildpackGUID, buildpackUpdatedAt)
+}
+
+// firstNotifiedTimes indexes when anyone was first notified about each app being outdated by each buildpack
+// release, keyed by appReleaseKey. It is built in one pass over the notifications, so build it once and look
+// each app up in it.
+func (s *savedState) firstNotifiedTimes() map[string]time.Time {
+	firstNotified := make(map[string]time.Time)
+	for _, record := range s.Notifications {
+		if record.SentAt == "" {
+			continue
+		}
+		sentAt, err := time.Parse(time.RFC3339, record.SentAt)
+		if err != nil {
+			continue
+		}
+		key := appReleaseKey(record.AppGUID, record.BuildpackGUID, record.BuildpackUpdatedAt)
+		if first, found := firstNotified[key]; !found || sentAt.Before(first) {
+			firstNotified[key] = sentAt
+		}
+	}
+	return firstNotified
+}
+
+// escalatedApps returns the keys of the apps and buildpack releases which escalations have already been attempted for.
+func (s *savedState) escalatedApps() map[string]bool {
+	apps := make(map[string]bool)
+	for _, record := range s.Escalations {
+		apps[appReleaseKey(record.AppGUID, record.BuildpackGUID, record.BuildpackUpdatedAt)] = true
+	}
+	return apps
+}
+
+// pendingEscalations returns the keys of the buildpack releases which have escalations to retry.
+func (s *savedState) pendingEscalations() map[string]bool {
+	releases := make(map[string]bool)
+	for _, record := range s.Escalations {
+		if record.SentAt == "" {
+			releases[releaseKey(record.BuildpackGUID, record.BuildpackUpdatedAt)] = true
+		}
+	}
+	return releases
+}
+
+// hasDueEscalations checks whether any apps outdated by the buildpack release were first notified about
+// more than escalationDays ago and either haven't been escalated yet or have escalations to retry.
+// firstNotified, escalatedApps and pendingEscalations are the indexes from firstNotifiedTimes, escalatedApps
+// and pendingEscalations, which are built once for all the buildpacks.
+func (s *savedState) hasDueEscalations(buildpackGUID, buildpackUpdatedAt string, escalationDays int, now time.Time, firstNotified map[string]time.Time, escalatedApps map[string]bool, pendingEscalations map[string]bool) bool {
+	if escalationDays <= 0 {
+		return false
+	}
+	if pendingEscalations[releaseKey(buildpackGUID, buildpackUpdatedAt)] {
+		return true
+	}
+	for _, record := range s.Notifications {
+		if record.BuildpackGUID != buildpackGUID || record.BuildpackUpdatedAt != buildpackUpdatedAt {
+			continue
+		}
+		key := appReleaseKey(record.AppGUID, buildpackGUID, buildpackUpdatedAt)
+		if escalatedApps[key] {
+			continue
+		}
+		firstNotifiedAt, found := firstNotified[key]
+		if found && now.Sub(firstNotifiedAt) >= time.Duration(escalationDays)*24*time.Hour {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeState(t *testing.T) {
+	expectedBuildpacks := map[string]buildpackRecord{
+		"buildpack1-guid": {LastUpdatedAt: "2016-06-08T16:41:45Z"},
+	}
+	testCases := []struct {
+		name        string
+		state       string
+		expected    map[string]buildpackRecord
+		expectError bool
+	}{
+		{"unversioned", `{"buildpack1-guid":{"LastUpdatedAt":"2016-06-08T16:41:45Z"}}`, expectedBuildpacks, false},
+		{"unversioned empty", `{}`, map[string]buildpackRecord{}, false},
+		{"version 1", `{"schema_version":1,"written_at":"2017-06-08T16:41:45Z","tool_version":"dev","buildpacks":{"buildpack1-guid":{"LastUpdatedAt":"2016-06-08T16:41:45Z"}}}`, expectedBuildpacks, false},
+		{"newer version", `{"schema_version":2,"buildpacks":{}}`, nil, true},
+		{"invalid", `[]`, nil, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state, err := decodeState(strings.NewReader(tc.state))
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Test %s failed. Expected error, got none", tc.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Test %s failed. Unexpected error %s", tc.name, err)
+			}
+			if state.SchemaVersion != stateSchemaVersion {
+				t.Errorf("Test %s failed. Expected schema version %d Actual %d", tc.name, stateSchemaVersion, state.SchemaVersion)
+			}
+			if state.Webhooks == nil {
+				t.Errorf("Test %s failed. Expected webhook history to be created", tc.name)
+			}
+			if state.Snoozes == nil {
+				t.Errorf("Test %s failed. Expected snoozes to be created", tc.name)
+			}
+			if !reflect.DeepEqual(state.Buildpacks, tc.expected) {
+				t.Errorf("Test %s failed. Expected %+v Actual %+v", tc.name, tc.expected, state.Buildpacks)
+			}
+		})
+	}
+}
+
+func TestEncodeStateWritesCurrentVersion(t *testing.T) {
+	state, err := decodeState(strings.NewReader(`{"buildpack1-guid":{"LastUpdatedAt":"2016-06-08T16:41:45Z"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := new(bytes.Buffer)
+	if err := encodeState(body, state); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body.String(), fmt.Sprintf(`"schema_version":%d`, stateSchemaVersion)) {
+		t.Errorf("Expected encoded state to contain the schema version. Actual %s", body.String())
+	}
+	if state.WrittenAt == "" || state.ToolVersion != version {
+		t.Errorf("Expected encoded state to be stamped. Actual %+v", state)
+	}
+}
+
+func TestRemindersDue(t *testing.T) {
+	now := time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+	schedule := []int{7, 14, 30}
+	testCases := []struct {
+		name            string
+		firstNotifiedAt string
+		expected        int
+	}{
+		{"notified today", "2020-01-31T00:00:00Z", 0},
+		{"first reminder due", "2020-01-24T00:00:00Z", 1},
+		{"second reminder due", "2020-01-17T00:00:00Z", 2},
+		{"all reminders due", "2019-12-01T00:00:00Z", 3},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			firstNotifiedAt, _ := time.Parse(time.RFC3339, tc.firstNotifiedAt)
+			if count := remindersDue(firstNotifiedAt, schedule, now); count != tc.expected {
+				t.Errorf("Test %s failed. Expected %d Actual %d", tc.name, tc.expected, count)
+			}
+		})
+	}
+}
+
+func TestFirstNotifiedTimes(t *testing.T) {
+	state := newSavedState()
+	records := []notificationRecord{
+		{Recipient: "a@example.com", AppGUID: "app1", BuildpackGUID: "bp1", BuildpackUpdatedAt: "v1", SentAt: "2020-01-10T00:00:00Z"},
+		{Recipient: "b@example.com", AppGUID: "app1", BuildpackGUID: "bp1", BuildpackUpdatedAt: "v1", SentAt: "2020-01-05T00:00:00Z"},
+		{Recipient: "c@example.com", AppGUID: "app1", BuildpackGUID: "bp1", BuildpackUpdatedAt: "v1"},
+		{Recipient: "a@example.com", AppGUID: "app1", BuildpackGUID: "bp2", BuildpackUpdatedAt: "v1", SentAt: "2020-01-20T00:00:00Z"},
+		{Recipient: "a@example.com", AppGUID: "app2", BuildpackGUID: "bp1", BuildpackUpdatedAt: "v1"},
+	}
+	for _, record := range records {
+		state.Notifications[notificationKey(record.Recipient, record.AppGUID, record.BuildpackGUID, record.BuildpackUpdatedAt)] = record
+	}
+	expected := map[string]time.Time{
+		appReleaseKey("app1", "bp1", "v1"): time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC),
+		appReleaseKey("app1", "bp2", "v1"): time.Date(2020, 1, 20, 0, 0, 0, 0, time.UTC),
+	}
+	if actual := state.firstNotifiedTimes(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Test TestFirstNotifiedTimes failed. Expected %v Actual %v", expected, actual)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	// Register the database/sql drivers for the SQL state store.
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// filePairStateStore reads state from IN_STATE and writes it to OUT_STATE.
+	filePairStateStore = "files"
+	// fileStateStore reads and writes state in place in STATE_FILE.
+	fileStateStore = "file"
+	// sqliteStateStore keeps state in the SQLite database at DATABASE_URL.
+	sqliteStateStore = "sqlite"
+	// postgresStateStore keeps state in the Postgres database at DATABASE_URL.
+	postgresStateStore = "postgres"
+)
+
+// StateStore is an interface that any place we keep state between runs should implement.
+type StateStore interface {
+	// Load reads the state saved by the last run.
+	Load() (*savedState, error)
+	// Save stores the state for the next run.
+	Save(state *savedState) error
+	// Preserve is used instead of Save when the run should not modify the state,
+	// e.g. in dry-run mode.
+	Preserve() error
+	// Close releases anything the store holds open between Load and Save.
+	Close() error
+}
+
+// newStateStore creates the state store selected in the config.
+func newStateStore(config Config) (StateStore, error) {
+	switch config.StateStore {
+	case filePairStateStore:
+		if config.InState == "" || config.OutState == "" {
+			return nil, fmt.Errorf("IN_STATE and OUT_STATE are required for the %s state store", config.StateStore)
+		}
+		return &filePairStore{inPath: config.InState, outPath: config.OutState}, nil
+	case fileStateStore:
+		if config.StateFile == "" {
+			return nil, fmt.Errorf("STATE_FILE is required for the %s state store", config.StateStore)
+		}
+		return &fileStore{path: config.StateFile}, nil
+	case sqliteStateStore, postgresStateStore:
+		if config.DatabaseURL == "" {
+			return nil, fmt.Errorf("DATABASE_URL is required for the %s state store", config.StateStore)
+		}
+		return newSQLStore(config.StateStore, config.DatabaseURL)
+	}
+	return nil, fmt.Errorf("unknown state store %q", config.StateStore)
+}
+
+func loadState(path string) (*savedState, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return decodeState(fp)
+}
+
+func copyState(inPath, outPath string) error {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func saveState(state *savedState, path string) error {
+	fp, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return encodeState(fp, state)
+}
+
+// filePairStore reads state from one file and writes it to another.
+// This is how state is passed between runs by CI resources.
+type filePairStore struct {
+	inPath  string
+	outPath string
+}
+
+func (s *filePairStore) Load() (*savedState, error) {
+	return loadState(s.inPath)
+}
+
+func (s *filePairStore) Save(state *savedState) error {
+	return saveState(state, s.outPath)
+}
+
+// Preserve copies the input state unchanged so the output is always written.
+func (s *filePairStore) Preserve() error {
+	return copyState(s.inPath, s.outPath)
+}
+
+func (s *filePairStore) Close() error {
+	return nil
+}
+
+// fileStore reads and writes state in a single file.
+// The file is replaced atomically so a failed run never leaves partial state behind.
+type fileStore struct {
+	path string
+}
+
+// Load returns empty state if the file doesn't exist yet.
+func (s *fileStore) Load() (*savedState, error) {
+	state, err := loadState(s.path)
+	if os.IsNotExist(err) {
+		return newSavedState(), nil
+	}
+	return state, err
+}
+
+// Save writes the state to a temporary file next to the state file and renames it into place.
+func (s *fileStore) Save(state *savedState) error {
+	fp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if err := encodeState(fp, state); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), s.path)
+}
+
+// Preserve does nothing because the state file is only changed by Save.
+func (s *fileStore) Preserve() error {
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// sqlStore keeps state as a JSON document in a single row of a SQL table.
+// The same schema works for both SQLite and Postgres.
+type sqlStore struct {
+	db *sql.DB
+}
+
+const (
+	sqlStateName        = "state"
+	createStateTableSQL = `CREATE TABLE IF NOT EXISTS buildpack_notify_state (
+	name TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+)`
+	selectStateSQL = `SELECT data FROM buildpack_notify_state WHERE name = $1`
+	upsertStateSQL = `INSERT INTO buildpack_notify_state (name, data) VALUES ($1, $2)
+ON CONFLICT (name) DO UPDATE SET data = excluded.data`
+)
+
+// newSQLStore opens the database and makes sure the state table exists.
+// The store types are named after the database/sql drivers they use.
+func newSQLStore(driverName string, databaseURL string) (*sqlStore, error) {
+	db, err := sql.Open(driverName, databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(createStateTableSQL); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db}, nil
+}
+
+// Load returns empty state if no state has been saved yet.
+func (s *sqlStore) Load() (*savedState, error) {
+	var data string
+	err := s.db.QueryRow(selectStateSQL, sqlStateName).Scan(&data)
+	if err == sql.ErrNoRows {
+		return newSavedState(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(strings.NewReader(data))
+}
+
+func (s *sqlStore) Save(state *savedState) error {
+	data := new(bytes.Buffer)
+	if err := encodeState(data, state); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(upsertStateSQL, sqlStateName, data.String())
+	return err
+}
+
+// Preserve does nothing because the database is only changed by Save.
+func (s *sqlStore) Preserve() error {
+	return nil
+}
+
+// Close closes the database so connections don't pile up when serve runs repeatedly.
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
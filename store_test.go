@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewStateStore(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		name        string
+		config      Config
+		expectError bool
+	}{
+		{"files", Config{StateStore: filePairStateStore, InState: "in.json", OutState: "out.json"}, false},
+		{"files missing out state", Config{StateStore: filePairStateStore, InState: "in.json"}, true},
+		{"file", Config{StateStore: fileStateStore, StateFile: "state.json"}, false},
+		{"file missing state file", Config{StateStore: fileStateStore}, true},
+		{"sqlite", Config{StateStore: sqliteStateStore, DatabaseURL: filepath.Join(dir, "state.db")}, false},
+		{"sqlite missing database url", Config{StateStore: sqliteStateStore}, true},
+		{"postgres missing database url", Config{StateStore: postgresStateStore}, true},
+		{"unknown", Config{StateStore: "s3"}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store, err := newStateStore(tc.config)
+			if err == nil {
+				defer store.Close()
+			}
+			if tc.expectError && err == nil {
+				t.Errorf("Test %s failed. Expected error, got none", tc.name)
+			}
+			if !tc.expectError && err != nil {
+				t.Errorf("Test %s failed. Unexpected error %s", tc.name, err)
+			}
+		})
+	}
+}
+
+func TestStateStores(t *testing.T) {
+	state := newSavedState()
+	state.Buildpacks = map[string]buildpackRecord{
+		"buildpack1-guid": {LastUpdatedAt: "2016-06-08T16:41:45Z"},
+		"buildpack2-guid": {LastUpdatedAt: "2017-06-08T16:41:45Z"},
+	}
+	testCases := []struct {
+		name     string
+		newStore func(t *testing.T, dir string) StateStore
+	}{
+		{
+			"files",
+			func(t *testing.T, dir string) StateStore {
+				inPath := filepath.Join(dir, "in.json")
+				if err := os.WriteFile(inPath, []byte("{}\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return &filePairStore{inPath: inPath, outPath: filepath.Join(dir, "out.json")}
+			},
+		},
+		{
+			"file",
+			func(t *testing.T, dir string) StateStore {
+				return &fileStore{path: filepath.Join(dir, "state.json")}
+			},
+		},
+		{
+			"sqlite",
+			func(t *testing.T, dir string) StateStore {
+				store, err := newSQLStore(sqliteStateStore, filepath.Join(dir, "state.db"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return store
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := tc.newStore(t, dir)
+			defer store.Close()
+			loaded, err := store.Load()
+			if err != nil {
+				t.Fatalf("Test %s failed. Unable to load empty state. Error %s", tc.name, err)
+			}
+			if len(loaded.Buildpacks) != 0 {
+				t.Errorf("Test %s failed. Expected empty state, got %+v", tc.name, loaded)
+			}
+			if err := store.Save(state); err != nil {
+				t.Fatalf("Test %s failed. Unable to save state. Error %s", tc.name, err)
+			}
+			// The file pair store writes to a different file than it reads.
+			if pair, ok := store.(*filePairStore); ok {
+				store = &filePairStore{inPath: pair.outPath, outPath: pair.inPath}
+			}
+			loaded, err = store.Load()
+			if err != nil {
+				t.Fatalf("Test %s failed. Unable to load saved state. Error %s", tc.name, err)
+			}
+			if !reflect.DeepEqual(loaded.Buildpacks, state.Buildpacks) {
+				t.Errorf("Test %s failed. Expected %+v Actual %+v", tc.name, state.Buildpacks, loaded.Buildpacks)
+			}
+			if err := store.Preserve(); err != nil {
+				t.Errorf("Test %s failed. Unable to preserve state. Error %s", tc.name, err)
+			}
+			if err := store.Close(); err != nil {
+				t.Errorf("Test %s failed. Unable to close state store. Error %s", tc.name, err)
+			}
+		})
+	}
+}
+
+func TestFileStoreSaveLeavesNoTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	store := &fileStore{path: filepath.Join(dir, "state.json")}
+	if err := store.Save(newSavedState()); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "state.json" {
+		t.Errorf("Expected only state.json in %s, found %v", dir, entries)
+	}
+}
@@ -5,12 +5,13 @@ import (
 	"html/template"
 	"io"
 	"path/filepath"
-
-	cfclient "github.com/cloudfoundry-community/go-cfclient"
 )
 
 const (
-	notifyTemplate = "NOTIFY_TEMPLATE"
+	notifyTemplate     = "NOTIFY_TEMPLATE"
+	notifyHTMLTemplate = "NOTIFY_HTML_TEMPLATE"
+	reminderTemplate   = "REMINDER_TEMPLATE"
+	escalationTemplate = "ESCALATION_TEMPLATE"
 )
 
 // Templates serve as a mapping to various templates.
@@ -39,7 +40,10 @@ func initTemplates() (*Templates, error) {
 // given the basePath of where to look.
 func findTemplates() map[string][]string {
 	return map[string][]string{
-		notifyTemplate: []string{filepath.Join("templates", "mail", "notify.txt")},
+		notifyTemplate:     []string{filepath.Join("templates", "mail", "notify.txt")},
+		notifyHTMLTemplate: []string{filepath.Join("templates", "mail", "notify.html")},
+		reminderTemplate:   []string{filepath.Join("templates", "mail", "reminder.txt")},
+		escalationTemplate: []string{filepath.Join("templates", "mail", "escalation.txt")},
 	}
 }
 
@@ -50,10 +54,10 @@ func (t *Templates) getTemplate(templateKey string) (*template.Template, error)
 	return nil, fmt.Errorf("unable to find template with key %s", templateKey)
 }
 
-// notifyEmail provides struct for the templates/mail/notify.tmpl
+// notifyEmail provides struct for the templates/mail/notify.txt and templates/mail/notify.html
 type notifyEmail struct {
 	Username      string
-	Apps          []cfclient.App
+	Apps          []notifyApp
 	IsMultipleApp bool
 	Buildpacks    []buildpackReleaseInfo
 }
@@ -66,3 +70,41 @@ func (t *Templates) getNotifyEmail(rw io.Writer, email notifyEmail) error {
 	}
 	return tpl.Execute(rw, email)
 }
+
+// getNotifyEmailHTML gets the filled in HTML notify email template.
+// It is sent alongside the plain-text body from getNotifyEmail.
+func (t *Templates) getNotifyEmailHTML(rw io.Writer, email notifyEmail) error {
+	tpl, err := t.getTemplate(notifyHTMLTemplate)
+	if err != nil {
+		return err
+	}
+	return tpl.Execute(rw, email)
+}
+
+// getReminderEmail gets the filled in reminder email template.
+// Reminders are about apps the user was already notified about, so they use the same data.
+func (t *Templates) getReminderEmail(rw io.Writer, email notifyEmail) error {
+	tpl, err := t.getTemplate(reminderTemplate)
+	if err != nil {
+		return err
+	}
+	return tpl.Execute(rw, email)
+}
+
+// escalationEmail provides struct for the templates/mail/escalation.txt
+type escalationEmail struct {
+	Username       string
+	Apps           []notifyApp
+	IsMultipleApp  bool
+	Buildpacks     []buildpackReleaseInfo
+	EscalationDays int
+}
+
+// getEscalationEmail gets the filled in escalation email template.
+func (t *Templates) getEscalationEmail(rw io.Writer, email escalationEmail) error {
+	tpl, err := t.getTemplate(escalationTemplate)
+	if err != nil {
+		return err
+	}
+	return tpl.Execute(rw, email)
+}
@@ -6,59 +6,124 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
-
-	cfclient "github.com/cloudfoundry-community/go-cfclient"
 )
 
 func TestGetNotifyEmail(t *testing.T) {
 	rootDataPath := filepath.Join("testdata", "mail", "notify")
-	updatedBuildpacksSingleApp := []buildpackReleaseInfo{
+	reminderDataPath := filepath.Join("testdata", "mail", "reminder")
+	pythonBuildpack := buildpackReleaseInfo{
+		"python_buildpack",
+		"v1.7.43",
+		"https://github.com/cloudfoundry/python-buildpack/releases/tags/v1.7.43",
+		"python-guid",
+		"2016-06-08T16:41:45Z",
+	}
+	rubyBuildpack := buildpackReleaseInfo{
+		"ruby_buildpack",
+		"v1.8.43",
+		"https://github.com/cloudfoundry/ruby-buildpack/releases/tags/v1.8.43",
+		"ruby-guid",
+		"2016-06-08T16:41:45Z",
+	}
+	nodejsBuildpack := buildpackReleaseInfo{
+		"nodejs_buildpack",
+		"v1.6.2",
+		"https://github.com/cloudfoundry/nodejs-buildpack/releases/tags/v1.6.2",
+		"nodejs-guid",
+		"2016-06-08T16:41:45Z",
+	}
+	updatedBuildpacksSingleApp := []buildpackReleaseInfo{pythonBuildpack}
+	updatedBuildpacksMultipleApps := []buildpackReleaseInfo{pythonBuildpack, rubyBuildpack}
+	testCases := []struct {
+		name                  string
+		email                 notifyEmail
+		expectedEmail         string
+		expectedReminderEmail string
+		expectedHTMLEmail     string
+	}{
 		{
-			"python_buildpack",
-			"v1.7.43",
-			"https://github.com/cloudfoundry/python-buildpack/releases/tags/v1.7.43",
+			"single app",
+			notifyEmail{"test@example.com", []notifyApp{{App: App{Name: "my-drupal-app", Space: Space{Name: "dev"}, Org: Organization{Name: "sandbox"}}, Buildpack: pythonBuildpack, OutdatedBuildpacks: []buildpackReleaseInfo{pythonBuildpack}, DropletAgeDays: 12}}, false, updatedBuildpacksSingleApp},
+			filepath.Join(rootDataPath, "single_app.txt"),
+			filepath.Join(reminderDataPath, "single_app.txt"),
+			filepath.Join(rootDataPath, "single_app.html"),
 		},
-	}
-	updatedBuildpacksMultipleApps := []buildpackReleaseInfo{
 		{
-			"python_buildpack",
-			"v1.7.43",
-			"https://github.com/cloudfoundry/python-buildpack/releases/tags/v1.7.43",
+			"multiple apps",
+			notifyEmail{"test@example.com", []notifyApp{
+				{App: App{Name: "my-drupal-app", Space: Space{Name: "dev"}, Org: Organization{Name: "sandbox"}}, Buildpack: pythonBuildpack, OutdatedBuildpacks: []buildpackReleaseInfo{pythonBuildpack}, DropletAgeDays: 12},
+				{App: App{Name: "my-wordpress-app", Space: Space{Name: "staging"}, Org: Organization{Name: "paid-org"}}, Buildpack: rubyBuildpack, OutdatedBuildpacks: []buildpackReleaseInfo{rubyBuildpack}, DropletAgeDays: 40},
+			}, true, updatedBuildpacksMultipleApps},
+			filepath.Join(rootDataPath, "multiple_apps.txt"),
+			filepath.Join(reminderDataPath, "multiple_apps.txt"),
+			filepath.Join(rootDataPath, "multiple_apps.html"),
 		},
 		{
-			"ruby_buildpack",
-			"v1.8.43",
-			"https://github.com/cloudfoundry/ruby-buildpack/releases/tags/v1.8.43",
+			"multiple buildpacks",
+			notifyEmail{"test@example.com", []notifyApp{
+				{App: App{Name: "my-django-app", Space: Space{Name: "dev"}, Org: Organization{Name: "sandbox"}}, Buildpack: nodejsBuildpack, OutdatedBuildpacks: []buildpackReleaseInfo{nodejsBuildpack, pythonBuildpack}, DropletAgeDays: 7},
+			}, false, []buildpackReleaseInfo{nodejsBuildpack, pythonBuildpack}},
+			filepath.Join(rootDataPath, "multiple_buildpacks.txt"),
+			filepath.Join(reminderDataPath, "multiple_buildpacks.txt"),
+			filepath.Join(rootDataPath, "multiple_buildpacks.html"),
 		},
 	}
+	for _, tc := range testCases {
+		templates, err := initTemplates()
+		if err != nil {
+			t.Fatalf("Unable to init templates. Error %s", err.Error())
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			body := new(bytes.Buffer)
+			err := templates.getNotifyEmail(body, tc.email)
+			if err != nil {
+				t.Errorf("Can't construct final email. Error %s", err.Error())
+			}
+			checkEmail(t, tc.name, body, tc.expectedEmail)
+		})
+		t.Run(tc.name+" html", func(t *testing.T) {
+			body := new(bytes.Buffer)
+			err := templates.getNotifyEmailHTML(body, tc.email)
+			if err != nil {
+				t.Errorf("Can't construct final email. Error %s", err.Error())
+			}
+			checkEmail(t, tc.name+" html", body, tc.expectedHTMLEmail)
+		})
+		t.Run(tc.name+" reminder", func(t *testing.T) {
+			body := new(bytes.Buffer)
+			err := templates.getReminderEmail(body, tc.email)
+			if err != nil {
+				t.Errorf("Can't construct final email. Error %s", err.Error())
+			}
+			checkEmail(t, tc.name+" reminder", body, tc.expectedReminderEmail)
+		})
+	}
+}
+
+func TestGetEscalationEmail(t *testing.T) {
+	rootDataPath := filepath.Join("testdata", "mail", "escalation")
+	pythonBuildpack := buildpackReleaseInfo{
+		"python_buildpack",
+		"v1.7.43",
+		"https://github.com/cloudfoundry/python-buildpack/releases/tags/v1.7.43",
+		"python-guid",
+		"2016-06-08T16:41:45Z",
+	}
+	drupalApp := notifyApp{App: App{Name: "my-drupal-app", Space: Space{Name: "dev"}, Org: Organization{Name: "sandbox"}}, Buildpack: pythonBuildpack, OutdatedBuildpacks: []buildpackReleaseInfo{pythonBuildpack}, DropletAgeDays: 45}
+	wordpressApp := notifyApp{App: App{Name: "my-wordpress-app", Space: Space{Name: "staging"}, Org: Organization{Name: "sandbox"}}, Buildpack: pythonBuildpack, OutdatedBuildpacks: []buildpackReleaseInfo{pythonBuildpack}, DropletAgeDays: 31}
 	testCases := []struct {
 		name          string
-		email         notifyEmail
+		email         escalationEmail
 		expectedEmail string
 	}{
 		{
 			"single app",
-			notifyEmail{"test@example.com", []cfclient.App{{Name: "my-drupal-app",
-				SpaceData: cfclient.SpaceResource{Entity: cfclient.Space{Name: "dev",
-					OrgData: cfclient.OrgResource{Entity: cfclient.Org{Name: "sandbox"}},
-				}},
-			}}, false, updatedBuildpacksSingleApp},
+			escalationEmail{"test@example.com", []notifyApp{drupalApp}, false, []buildpackReleaseInfo{pythonBuildpack}, 30},
 			filepath.Join(rootDataPath, "single_app.txt"),
 		},
 		{
 			"multiple apps",
-			notifyEmail{"test@example.com", []cfclient.App{
-				{Name: "my-drupal-app",
-					SpaceData: cfclient.SpaceResource{Entity: cfclient.Space{Name: "dev",
-						OrgData: cfclient.OrgResource{Entity: cfclient.Org{Name: "sandbox"}},
-					}},
-				},
-				{Name: "my-wordpress-app",
-					SpaceData: cfclient.SpaceResource{Entity: cfclient.Space{Name: "staging",
-						OrgData: cfclient.OrgResource{Entity: cfclient.Org{Name: "paid-org"}},
-					}},
-				},
-			}, true, updatedBuildpacksMultipleApps},
+			escalationEmail{"test@example.com", []notifyApp{drupalApp, wordpressApp}, true, []buildpackReleaseInfo{pythonBuildpack}, 30},
 			filepath.Join(rootDataPath, "multiple_apps.txt"),
 		},
 	}
@@ -69,26 +134,31 @@ func TestGetNotifyEmail(t *testing.T) {
 		}
 		t.Run(tc.name, func(t *testing.T) {
 			body := new(bytes.Buffer)
-			err := templates.getNotifyEmail(body, tc.email)
+			err := templates.getEscalationEmail(body, tc.email)
 			if err != nil {
 				t.Errorf("Can't construct final email. Error %s", err.Error())
 			}
-			if os.Getenv("OVERRIDE_TEMPLATES") == "1" {
-				err := ioutil.WriteFile(tc.expectedEmail, body.Bytes(), 0644)
-				if err != nil {
-					t.Errorf("Can't save expected email. Error %s", err.Error())
-				}
-			}
-			expectedBody, err := ioutil.ReadFile(tc.expectedEmail)
-			if err != nil {
-				t.Fatalf("Unable to read expected file. %s", err.Error())
-			}
-			if string(expectedBody) != string(body.Bytes()) {
-				t.Logf("\n===========Expected %s e-mail case BEGIN===========\n%s\n===========Expected %s e-mail case END===========\n", tc.name, string(expectedBody), tc.name)
-				t.Logf("\n===========Actual %s e-mail case BEGIN===========\n%s\n===========Actual %s e-mail case END===========\n", tc.name, string(body.Bytes()), tc.name)
-				t.Errorf("Test %s failed. For the actual output, inspect %s.returned.", tc.name, filepath.Base(tc.expectedEmail))
-				ioutil.WriteFile(filepath.Join(rootDataPath, filepath.Base(tc.expectedEmail)+".returned"), body.Bytes(), 0644)
-			}
+			checkEmail(t, tc.name, body, tc.expectedEmail)
 		})
 	}
 }
+
+// checkEmail compares the rendered email to the pre-rendered email in expectedEmail.
+func checkEmail(t *testing.T, name string, body *bytes.Buffer, expectedEmail string) {
+	if os.Getenv("OVERRIDE_TEMPLATES") == "1" {
+		err := ioutil.WriteFile(expectedEmail, body.Bytes(), 0644)
+		if err != nil {
+			t.Errorf("Can't save expected email. Error %s", err.Error())
+		}
+	}
+	expectedBody, err := ioutil.ReadFile(expectedEmail)
+	if err != nil {
+		t.Fatalf("Unable to read expected file. %s", err.Error())
+	}
+	if string(expectedBody) != string(body.Bytes()) {
+		t.Logf("\n===========Expected %s e-mail case BEGIN===========\n%s\n===========Expected %s e-mail case END===========\n", name, string(expectedBody), name)
+		t.Logf("\n===========Actual %s e-mail case BEGIN===========\n%s\n===========Actual %s e-mail case END===========\n", name, string(body.Bytes()), name)
+		t.Errorf("Test %s failed. For the actual output, inspect %s.returned.", name, filepath.Base(expectedEmail))
+		ioutil.WriteFile(expectedEmail+".returned", body.Bytes(), 0644)
+	}
+}
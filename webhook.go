@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxConsecutiveWebhookFailures is how many deliveries in a row can fail before the endpoint is assumed
+// to be down and the rest of the run's events are left for the next run, so retries don't hold up the run.
+const maxConsecutiveWebhookFailures = 3
+
+// webhookSignatureHeader carries the hex encoded HMAC-SHA256 of the request body, keyed with the webhook secret.
+const webhookSignatureHeader = "X-Buildpack-Notify-Signature"
+
+// webhookEvent is the JSON payload posted to the webhook for each outdated app.
+type webhookEvent struct {
+	Event            string `json:"event"`
+	AppGUID          string `json:"app_guid"`
+	AppName          string `json:"app_name"`
+	OrgName          string `json:"org_name"`
+	SpaceName        string `json:"space_name"`
+	BuildpackName    string `json:"buildpack_name"`
+	BuildpackVersion string `json:"buildpack_version"`
+	ReleaseURL       string `json:"release_url,omitempty"`
+	DropletCreatedAt string `json:"droplet_created_at,omitempty"`
+}
+
+// newWebhookEvent creates the event about the app being outdated.
+func newWebhookEvent(app notifyApp) webhookEvent {
+	return webhookEvent{
+		Event:            "app.outdated",
+		AppGUID:          app.GUID,
+		AppName:          app.Name,
+		OrgName:          app.Org.Name,
+		SpaceName:        app.Space.Name,
+		BuildpackName:    app.Buildpack.BuildpackName,
+		BuildpackVersion: app.Buildpack.BuildpackVersion,
+		ReleaseURL:       app.Buildpack.BuildpackURL,
+		DropletCreatedAt: app.DropletCreatedAt,
+	}
+}
+
+// InitWebhookSender creates a new sender which posts signed events to the configured webhook.
+func InitWebhookSender(config Config) *webhookSender {
+	return &webhookSender{
+		url:         config.WebhookURL,
+		secret:      []byte(config.WebhookSecret),
+		maxAttempts: config.WebhookMaxAttempts,
+		backoff:     time.Second,
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type webhookSender struct {
+	url         string
+	secret      []byte
+	maxAttempts int
+	// backoff is how long to wait before the first retry. It doubles after each retry.
+	backoff time.Duration
+	client  *http.Client
+}
+
+// webhookError is a failed delivery. Only temporary failures are worth retrying.
+type webhookError struct {
+	statusCode int
+	err        error
+}
+
+func (e *webhookError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("webhook returned status %d", e.statusCode)
+}
+
+func (e *webhookError) temporary() bool {
+	return e.err != nil || e.statusCode == http.StatusTooManyRequests || e.statusCode >= 500
+}
+
+// Send posts the event, retrying temporary failures with exponential backoff.
+func (w *webhookSender) Send(event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		err := w.post(body)
+		if err == nil {
+			return nil
+		}
+		if !err.temporary() || attempt >= w.maxAttempts {
+			return fmt.Errorf("delivery failed after %d attempt(s): %s", attempt, err)
+		}
+		log.Printf("Webhook delivery for app %s failed, retrying in %s. Error: %s\n", event.AppGUID, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *webhookSender) post(body []byte) *webhookError {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return &webhookError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookBody(w.secret, body))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return &webhookError{err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &webhookError{statusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// signWebhookBody gets the hex encoded HMAC-SHA256 of the body.
+func signWebhookBody(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhookEvents posts an event for each app which hasn't been delivered for its buildpack release yet,
+// including deliveries which failed in earlier runs. It returns the number of events delivered and an error
+// for each event which couldn't be delivered. After maxConsecutiveWebhookFailures failures in a row the
+// remaining events are recorded as pending without being attempted.
+func sendWebhookEvents(apps []notifyApp, sender *webhookSender, state *savedState, dryRun bool) (int, error) {
+	sent := 0
+	failures := 0
+	var errs []error
+	for _, app := range apps {
+		if state.isWebhookDelivered(sender.url, app) {
+			continue
+		}
+		if failures >= maxConsecutiveWebhookFailures {
+			state.deferWebhook(sender.url, app, "not attempted because earlier deliveries failed")
+			continue
+		}
+		if !dryRun {
+			err := sender.Send(newWebhookEvent(app))
+			state.recordWebhook(sender.url, app, err)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to deliver webhook event for app %s: %s", app.GUID, err))
+				failures++
+				if failures == maxConsecutiveWebhookFailures {
+					log.Printf("Webhook delivery failed %d times in a row. Remaining events are left for the next run\n", failures)
+				}
+				continue
+			}
+		}
+		failures = 0
+		fmt.Printf("Delivered webhook event for app %s\n", app.GUID)
+		sent++
+	}
+	return sent, errors.Join(errs...)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestWebhookSender(url string) *webhookSender {
+	sender := InitWebhookSender(Config{WebhookURL: url, WebhookSecret: "secret", WebhookMaxAttempts: 3})
+	sender.backoff = time.Millisecond
+	return sender
+}
+
+func TestWebhookSenderSignsEvents(t *testing.T) {
+	var event webhookEvent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if signature := r.Header.Get(webhookSignatureHeader); signature != "sha256="+signWebhookBody([]byte("secret"), body) {
+			t.Errorf("Signature %s does not match the body", signature)
+		}
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("Unable to decode event. Error: %s", err.Error())
+		}
+	}))
+	defer ts.Close()
+
+	app := notifyApp{
+		App:              App{GUID: "app1", Name: "my-app"},
+		Buildpack:        buildpackReleaseInfo{"python_buildpack", "v1.7.43", "https://github.com/cloudfoundry/python-buildpack/releases/tag/v1.7.43", "python-guid", "2016-06-08T16:41:45Z"},
+		DropletCreatedAt: "2016-01-01T00:00:00Z",
+	}
+	if err := newTestWebhookSender(ts.URL).Send(newWebhookEvent(app)); err != nil {
+		t.Fatalf("Unable to send event. Error: %s", err.Error())
+	}
+	if event.AppGUID != "app1" || event.BuildpackVersion != "v1.7.43" || event.DropletCreatedAt != "2016-01-01T00:00:00Z" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+func TestWebhookSenderRetries(t *testing.T) {
+	testCases := []struct {
+		name             string
+		statusCodes      []int
+		expectedAttempts int
+		expectedErr      bool
+	}{
+		{"succeeds first time", []int{200}, 1, false},
+		{"retries server errors", []int{500, 503, 200}, 3, false},
+		{"gives up after max attempts", []int{500, 500, 500, 200}, 3, true},
+		{"doesn't retry client errors", []int{400, 200}, 1, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.statusCodes[attempts])
+				attempts++
+			}))
+			defer ts.Close()
+			err := newTestWebhookSender(ts.URL).Send(webhookEvent{AppGUID: "app1"})
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("Test %s failed. Expected error %v, found %v", tc.name, tc.expectedErr, err)
+			}
+			if attempts != tc.expectedAttempts {
+				t.Errorf("Test %s failed. Expected %d attempts, found %d", tc.name, tc.expectedAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestSendWebhookEventsRecordsDeliveries(t *testing.T) {
+	failing := map[string]bool{"app2": true}
+	delivered := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		if failing[event.AppGUID] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delivered[event.AppGUID]++
+	}))
+	defer ts.Close()
+	sender := newTestWebhookSender(ts.URL)
+	pythonBuildpack := buildpackReleaseInfo{BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}
+	apps := []notifyApp{
+		{App: App{GUID: "app1"}, Buildpack: pythonBuildpack},
+		{App: App{GUID: "app2"}, Buildpack: pythonBuildpack},
+	}
+	state := newSavedState()
+
+	sent, err := sendWebhookEvents(apps, sender, state, false)
+	if sent != 1 || err == nil {
+		t.Errorf("Expected 1 event to be delivered and an error for the other, found %d and %v", sent, err)
+	}
+	if !state.hasPendingNotifications("python-guid", "2016-06-08T16:41:45Z") {
+		t.Error("Expected the failed delivery to be pending")
+	}
+
+	// Only the failed delivery is retried on the next run.
+	failing["app2"] = false
+	if sent, err := sendWebhookEvents(apps, sender, state, false); sent != 1 || err != nil {
+		t.Errorf("Expected 1 event to be delivered, found %d and error %v", sent, err)
+	}
+	if delivered["app1"] != 1 || delivered["app2"] != 1 {
+		t.Errorf("Expected each app to be delivered once, found %+v", delivered)
+	}
+	record := state.Webhooks[notificationKey(ts.URL, "app2", "python-guid", "2016-06-08T16:41:45Z")]
+	if record.Attempts != 2 || record.SentAt == "" || record.LastError != "" {
+		t.Errorf("Expected the retried delivery to be recorded. Actual %+v", record)
+	}
+	if state.hasPendingNotifications("python-guid", "2016-06-08T16:41:45Z") {
+		t.Error("Expected no deliveries to be pending")
+	}
+}
+
+func TestSendWebhookEventsStopsAfterConsecutiveFailures(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	sender := newTestWebhookSender(ts.URL)
+	pythonBuildpack := buildpackReleaseInfo{BuildpackGUID: "python-guid", BuildpackUpdatedAt: "2016-06-08T16:41:45Z"}
+	var apps []notifyApp
+	for _, guid := range []string{"app1", "app2", "app3", "app4", "app5"} {
+		apps = append(apps, notifyApp{App: App{GUID: guid}, Buildpack: pythonBuildpack})
+	}
+	state := newSavedState()
+
+	if sent, err := sendWebhookEvents(apps, sender, state, false); sent != 0 || err == nil {
+		t.Errorf("Expected no events to be delivered and an error, found %d and %v", sent, err)
+	}
+	if expected := maxConsecutiveWebhookFailures * sender.maxAttempts; requests != expected {
+		t.Errorf("Expected %d requests, found %d", expected, requests)
+	}
+	for i, app := range apps {
+		record, found := state.Webhooks[notificationKey(ts.URL, app.GUID, "python-guid", "2016-06-08T16:41:45Z")]
+		expectedAttempts := 0
+		if i < maxConsecutiveWebhookFailures {
+			expectedAttempts = 1
+		}
+		if !found || record.SentAt != "" || record.Attempts != expectedAttempts {
+			t.Errorf("Expected app %s to be pending with %d attempts. Actual %+v", app.GUID, expectedAttempts, record)
+		}
+	}
+}